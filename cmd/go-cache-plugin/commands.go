@@ -108,8 +108,10 @@ func runServe(env *command.Env) error {
 	}
 	defer modCleanup()
 
-	// If a reverse proxy is enabled, start it.
-	revProxy, err := initRevProxy(env.SetContext(ctx), s3c, &g)
+	// If a reverse proxy is enabled, start it. Its debug handlers are served
+	// by the HTTP server, if there is one.
+	debugMux := http.NewServeMux()
+	revProxy, err := initRevProxy(env.SetContext(ctx), s3c, &g, debugMux)
 	if err != nil {
 		lst.Close()
 		return fmt.Errorf("reverse proxy: %w", err)
@@ -120,7 +122,7 @@ func runServe(env *command.Env) error {
 	if serveFlags.HTTP != "" {
 		srv := &http.Server{
 			Addr:    serveFlags.HTTP,
-			Handler: makeHandler(modProxy, revProxy),
+			Handler: makeHandler(debugMux, modProxy, revProxy),
 		}
 		g.Go(srv.ListenAndServe)
 		vprintf("HTTP server listening at %q", serveFlags.HTTP)
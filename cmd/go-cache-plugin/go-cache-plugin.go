@@ -57,7 +57,9 @@ When --http is enabled, the following options are available:
 
 - When --revproxy is set, the server also hosts a caching reverse proxy for the
   specified hosts at http://<host>:<port>. The reverse proxy handles both HTTP
-  and HTTPS requests, and caches immutable successful responses.`,
+  and HTTPS requests, and caches immutable successful responses. For debugging,
+  the stored form of a cached object can be fetched from
+  /debug/cache/raw?hash=<key>.`,
 
 				SetFlags: command.Flags(flax.MustBind, &serveFlags),
 				Run:      command.Adapt(runServe),
@@ -168,7 +168,9 @@ func initModProxy(env *command.Env, s3c *blob.Bucket) (_ http.Handler, cleanup f
 // To the main HTTP listener, the bridge is an [http.Handler] that serves
 // requests routed to it. To the inner server, the bridge is a [net.Listener],
 // a source of client connections (with TLS terminated).
-func initRevProxy(env *command.Env, bucket *blob.Bucket, g *taskgroup.Group) (http.Handler, error) {
+//
+// Debug handlers for the proxy are added to debugMux.
+func initRevProxy(env *command.Env, bucket *blob.Bucket, g *taskgroup.Group, debugMux *http.ServeMux) (http.Handler, error) {
 	if serveFlags.RevProxy == "" {
 		return nil, nil // OK, proxy is disabled
 	} else if serveFlags.HTTP == "" {
@@ -195,6 +197,9 @@ func initRevProxy(env *command.Env, bucket *blob.Bucket, g *taskgroup.Group) (ht
 		Logf:        vprintf,
 		LogRequests: flags.DebugLog&debugRevProxy != 0,
 	}
+	if err := proxy.Validate(); err != nil {
+		return nil, fmt.Errorf("revproxy: %w", err)
+	}
 	bridge := &proxyconn.Bridge{
 		Addrs:   hosts,
 		Handler: proxy, // forward HTTP requests unencrypted to the proxy
@@ -223,6 +228,7 @@ func initRevProxy(env *command.Env, bucket *blob.Bucket, g *taskgroup.Group) (ht
 	})
 
 	expvar.Publish("revcache", proxy.Metrics())
+	tsweb.Debugger(debugMux).Handle("cache/raw", "Raw cached object (reverse proxy; ?hash=...)", proxy.RawHandler())
 	vprintf("enabling reverse proxy for %s", strings.Join(proxy.Targets, ", "))
 	return bridge, nil
 }
@@ -256,10 +262,9 @@ func initServerCert(env *command.Env, hosts []string) (tls.Certificate, error) {
 	return sc.TLSCertificate()
 }
 
-// makeHandler returns an HTTP handler that dispatches requests to debug
-// handlers or to the specified proxies, if they are defined.
-func makeHandler(modProxy, revProxy http.Handler) http.HandlerFunc {
-	mux := http.NewServeMux()
+// makeHandler returns an HTTP handler that dispatches requests to the debug
+// handlers of mux or to the specified proxies, if they are defined.
+func makeHandler(mux *http.ServeMux, modProxy, revProxy http.Handler) http.HandlerFunc {
 	tsweb.Debugger(mux)
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Host != "" && r.URL.Host == r.Host {
@@ -17,6 +17,8 @@ require (
 	github.com/goproxy/goproxy v0.18.0
 	gocloud.dev v0.40.0
 	golang.org/x/sync v0.8.0
+	golang.org/x/sys v0.26.0
+	golang.org/x/time v0.6.0
 	honnef.co/go/tools v0.5.1
 	tailscale.com v1.76.6
 )
@@ -88,9 +90,7 @@ require (
 	golang.org/x/mod v0.21.0 // indirect
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/oauth2 v0.22.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
-	golang.org/x/time v0.6.0 // indirect
 	golang.org/x/tools v0.23.0 // indirect
 	golang.org/x/xerrors v0.0.0-20240716161551-93cc26a95ae9 // indirect
 	google.golang.org/api v0.191.0 // indirect
@@ -4,26 +4,63 @@
 package revproxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/atomicfile"
-	"github.com/creachadair/scheddle"
 	"github.com/creachadair/taskgroup"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 // cacheLoadLocal reads cached headers and body from the local cache.
 func (s *Server) cacheLoadLocal(hash string) ([]byte, http.Header, error) {
+	if !s.diskAvailable() {
+		return nil, nil, fs.ErrNotExist
+	}
+	path := s.makePath(hash)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		s.recordDisk(err)
+		return nil, nil, err
+	}
+	body, hdr, err := parseCacheObject(data)
+	if errors.Is(err, errCorruptObject) {
+		s.healCorrupt(context.Background(), hash, "local", err)
+		return nil, nil, fs.ErrNotExist
+	} else if err == nil && isExpired(hdr, time.Now()) {
+		os.Remove(path)
+		return nil, nil, fs.ErrNotExist
+	}
+	body, hdr, err = s.checkVersion(hash, body, hdr, err, func() error { return os.Remove(path) })
+	if err == nil {
+		if body, err = resolveBodyRef(hdr, body, s.readLocalObject); err != nil {
+			s.vlogf("load %q: %v", hash, err)
+			os.Remove(path)
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+	return body, hdr, err
+}
+
+// readLocalObject reads and parses the object for hash from the local cache,
+// without checking its expiration or version, or resolving a shared body.
+func (s *Server) readLocalObject(hash string) ([]byte, http.Header, error) {
 	data, err := os.ReadFile(s.makePath(hash))
 	if err != nil {
 		return nil, nil, err
@@ -35,122 +72,781 @@ func (s *Server) cacheLoadLocal(hash string) ([]byte, http.Header, error) {
 //
 // The file format is a plain-text section at the top recording a subset of the
 // response headers, followed by "\n\n", followed by the response body.
+//
+// If hdr is the header of a stored object and records the checksum of the
+// body, it is reused rather than computed again.
 func (s *Server) cacheStoreLocal(hash string, hdr http.Header, body []byte) error {
+	return s.cacheStoreLocalFrom(hash, hdr, s.objectBody(hdr, body))
+}
+
+// cacheStoreLocalFrom writes the contents of body to the local cache, as
+// cacheStoreLocal. The caller remains responsible for closing body.
+//
+// If the local cache is disabled due to errors, it reports errDiskDisabled.
+func (s *Server) cacheStoreLocalFrom(hash string, hdr http.Header, body *bodyBuffer) error {
+	if !s.diskAvailable() {
+		return errDiskDisabled
+	}
 	path := s.makePath(hash)
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		s.recordDisk(err)
+		return err
+	}
+	hdr = withRetention(s.trimCacheHeader(hdr), s.DiskTTLMultiplier)
+	if s.PreventStaleOverwrite {
+		if old, err := s.readLocalHeader(hash); err == nil && isNewerObject(old, hdr) {
+			s.rspStaleOverwrite.Add(1)
+			s.vlogf("skip store %q local: a newer copy is stored", hash)
+			return nil
+		}
+	}
+	err := atomicfile.Tx(s.makePath(hash), 0644, func(f *atomicfile.File) error {
+		return s.writeObject(f, hdr, body)
+	})
+	s.recordDisk(err)
+	return err
+}
+
+// storedBodyHeaders are the headers of a stored cache object that describe its
+// body, and are kept when only its header is updated.
+var storedBodyHeaders = []string{
+	"Content-Length", bodyChecksumHeader, checksumAlgoHeader, checksumHeader, bodyRefHeader,
+}
+
+// cacheUpdateLocalHeader replaces the header of the object for hash in the
+// local cache with hdr, keeping its stored body, as when a refresh finds that
+// the content in body has not changed. The body and its recorded checksum are
+// copied from the stored object, rather than being written again from body.
+// If there is no stored object, it reports an error wrapping fs.ErrNotExist,
+// and if the stored object does not record the checksum of body, an error
+// wrapping errChecksumMismatch.
+//
+// If the local cache is disabled due to errors, it reports errDiskDisabled.
+func (s *Server) cacheUpdateLocalHeader(hash string, hdr http.Header, body *bodyBuffer) error {
+	if !s.diskAvailable() {
+		return errDiskDisabled
+	}
+	f, err := os.Open(s.makePath(hash))
+	if err != nil {
 		return err
 	}
-	return atomicfile.Tx(s.makePath(hash), 0644, func(f *atomicfile.File) error {
-		return writeCacheObject(f, hdr, body)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	old, hlen, err := readCacheHeader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	} else if sum := recordedChecksum(old, body.algo); sum != body.Checksum() {
+		return fmt.Errorf("%w: stored %q, want %q", errChecksumMismatch, sum, body.Checksum())
+	}
+	hdr = withRetention(s.trimCacheHeader(hdr), s.DiskTTLMultiplier)
+	if s.PreventStaleOverwrite && isNewerObject(old, hdr) {
+		s.rspStaleOverwrite.Add(1)
+		s.vlogf("skip store %q local: a newer copy is stored", hash)
+		return nil
+	}
+	for _, name := range storedBodyHeaders {
+		if v := old.Get(name); v != "" {
+			hdr.Set(name, v)
+		} else {
+			hdr.Del(name)
+		}
+	}
+	stored := io.NewSectionReader(f, hlen, fi.Size()-hlen)
+	err = atomicfile.Tx(s.makePath(hash), 0644, func(w *atomicfile.File) error {
+		writeCacheHeader(w, hdr)
+		_, err := copyStream(w, stored, make([]byte, s.streamChunkSize()))
+		return err
 	})
+	s.recordDisk(err)
+	return err
 }
 
 // cacheLoadS3 reads cached headers and body from the remote S3 cache.
+//
+// If S3ReadValidate is true and the object read is stale or corrupt, it is
+// read again after a short delay, in case a newer copy has been replicated.
+// If the object is still corrupt, it is treated as missing.
 func (s *Server) cacheLoadS3(ctx context.Context, hash string) ([]byte, http.Header, error) {
-	data, err := s.Bucket.ReadAll(ctx, s.makeKey(hash))
-	if err != nil {
-		return nil, nil, err
+	body, hdr, err := s.readS3Resolved(ctx, hash)
+	if errors.Is(err, errCorruptObject) {
+		s.healCorrupt(ctx, hash, "S3", err)
+		return nil, nil, fs.ErrNotExist
+	} else if err == nil && s.S3ReadValidate {
+		if verr := validateObject(hdr, body, time.Now()); verr != nil {
+			s.reqS3Invalid.Add(1)
+			s.logf("[s3] read %q: %v, retrying", hash, verr)
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(s3RetryDelay):
+			}
+			body, hdr, err = s.readS3Resolved(ctx, hash)
+			if err == nil {
+				if verr := validateObject(hdr, body, time.Now()); verr != nil {
+					s.logf("[s3] read %q: %v", hash, verr)
+					if errors.Is(verr, errChecksumMismatch) {
+						s.healCorrupt(ctx, hash, "S3", verr)
+						return nil, nil, fs.ErrNotExist
+					}
+				}
+			}
+		}
 	}
-	return parseCacheObject(data)
+	if err == nil && isExpired(hdr, time.Now()) {
+		return nil, nil, fs.ErrNotExist
+	}
+	return s.checkVersion(hash, body, hdr, err, func() error {
+		return s.bucket(hash).Delete(ctx, s.makeKey(hash))
+	})
+}
+
+// healCorrupt removes the object for hash from every tier, after err showed
+// the copy found in the named tier to be corrupt, so that the next request
+// fetches it afresh from the origin and stores it again. Unless
+// SelfHealCorruption is false, in which case the corrupt object is left in
+// place.
+//
+// The copy in S3 is removed before returning, so that the removal cannot race
+// with the upload of the replacement.
+func (s *Server) healCorrupt(ctx context.Context, hash, tier string, err error) {
+	if heal := s.SelfHealCorruption; heal != nil && !*heal {
+		s.logf("corrupt object %q in %s: %v", hash, tier, err)
+		return
+	}
+	s.reqSelfHeal.Add(1)
+	s.logf("self-heal %q: corrupt object in %s: %v; removing from all tiers", hash, tier, err)
+	s.memRemove(hash)
+	if rerr := os.Remove(s.makePath(hash)); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+		s.logf("self-heal %q: remove local: %v", hash, rerr)
+	}
+	dctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if derr := s.bucket(hash).Delete(dctx, s.makeKey(hash)); derr != nil && gcerrors.Code(derr) != gcerrors.NotFound {
+		s.logf("self-heal %q: remove S3: %v", hash, derr)
+	}
+}
+
+// checkVersion applies the OnVersionMismatch policy to the results of parsing
+// a cache object for hash. If err does not indicate a version mismatch, the
+// results are returned unmodified. Otherwise the mismatch is logged, and if
+// the policy is [VersionDelete], the object is removed by calling remove.
+func (s *Server) checkVersion(hash string, body []byte, hdr http.Header, err error, remove func() error) ([]byte, http.Header, error) {
+	if !errors.Is(err, errVersionMismatch) {
+		return body, hdr, err
+	}
+	s.reqVersionMismatch.Add(1)
+	s.logf("cache object %q: %v (%d mismatches so far)", hash, err, s.reqVersionMismatch.Value())
+
+	switch s.OnVersionMismatch {
+	case VersionParse:
+		return body, hdr, nil
+	case VersionDelete:
+		if rerr := remove(); rerr != nil {
+			s.logf("remove %q: %v", hash, rerr)
+		}
+	}
+	return nil, nil, err
 }
 
 // cacheStoreS3 returns a task that writes the contents of body to the remote
-// S3 cache.
+// S3 cache. As with cacheStoreLocal, a checksum recorded in hdr is reused.
 func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgroup.Task {
-	var buf bytes.Buffer
-	writeCacheObject(&buf, hdr, body)
-	nb := buf.Len()
+	return s.cacheStoreS3From(hash, hdr, s.objectBody(hdr, body))
+}
+
+// cacheStoreS3From returns a task that writes the contents of body to the
+// remote S3 cache, as cacheStoreS3. The task takes ownership of body, and
+// closes it when the write is complete.
+//
+// If there are ReplicaBuckets, the object is written to each of them at the
+// same time as to its primary bucket (see storeReplicas).
+func (s *Server) cacheStoreS3From(hash string, hdr http.Header, body *bodyBuffer) taskgroup.Task {
+	hdr = withRetention(s.trimCacheHeader(hdr), s.S3TTLMultiplier)
 	return func() error {
+		defer body.Close()
 		sctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 		defer cancel()
 
-		w, err := s.Bucket.NewWriter(sctx, s.makeKey(hash), &blob.WriterOptions{})
-		if err != nil {
-			s.logf("[s3] put %q failed: %v", hash, err)
-			s.rspPushError.Add(1)
-			return err
+		if len(s.ReplicaBuckets) != 0 {
+			return s.storeReplicas(sctx, hash, hdr, body)
 		}
-		defer w.Close()
+		return s.putPrimary(sctx, hash, hdr, body)
+	}
+}
 
-		_, err = io.Copy(w, &buf)
-		if err != nil {
-			s.logf("[s3] put %q failed: %v", hash, err)
-			s.rspPushError.Add(1)
-			return err
+// putPrimary writes the object for hash to its primary S3 bucket.
+func (s *Server) putPrimary(ctx context.Context, hash string, hdr http.Header, body *bodyBuffer) error {
+	n, err := s.putS3(ctx, s.bucket(hash), hash, hdr, body)
+	if errors.Is(err, errNewerStored) {
+		return nil
+	} else if err != nil {
+		s.logf("[s3] put %q failed: %v", hash, err)
+		s.rspPushError.Add(1)
+		return err
+	}
+	s.rspPush.Add(1)
+	s.rspPushBytes.Add(n)
+	return nil
+}
+
+// errNewerStored is reported by putS3 when PreventStaleOverwrite is set, and
+// the object was not written because a newer copy is already stored.
+var errNewerStored = errors.New("a newer copy is stored")
+
+// putS3 writes the object for hash, with header hdr and the contents of body,
+// to b. It returns the number of bytes written.
+//
+// If PreventStaleOverwrite is set, and b already has a copy of the object
+// with a later Date than hdr, the object is not written, and putS3 reports
+// errNewerStored.
+func (s *Server) putS3(ctx context.Context, b *blob.Bucket, hash string, hdr http.Header, body *bodyBuffer) (int64, error) {
+	if s.PreventStaleOverwrite {
+		if old, err := s.readBucketHeader(ctx, b, hash); err == nil && isNewerObject(old, hdr) {
+			s.rspStaleOverwrite.Add(1)
+			s.vlogf("[s3] skip put %q: %v", hash, errNewerStored)
+			return 0, errNewerStored
 		}
+	}
+	w, err := b.NewWriter(ctx, s.makeKey(hash), &blob.WriterOptions{})
+	if err != nil {
+		return 0, err
+	}
+	cw := &countWriter{w: w}
+	err = s.writeObject(cw, hdr, body)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return cw.n, err
+}
 
-		s.rspPush.Add(1)
-		s.rspPushBytes.Add(int64(nb))
-		return nil
+// openS3 opens the object for hash in S3. It is read from the primary bucket
+// for hash if possible. If that fails for a reason other than the object not
+// existing, such as the bucket being unavailable, each of the ReplicaBuckets
+// is tried in turn.
+func (s *Server) openS3(ctx context.Context, hash string) (*blob.Reader, error) {
+	key := s.makeKey(hash)
+	rd, err := s.bucket(hash).NewReader(ctx, key, nil)
+	for _, b := range s.ReplicaBuckets {
+		if err == nil || gcerrors.Code(err) == gcerrors.NotFound || ctx.Err() != nil {
+			break
+		}
+		s.logf("[s3] read %q: %v; trying a replica", hash, err)
+		rd, err = b.NewReader(ctx, key, nil)
 	}
+	return rd, err
+}
+
+// countWriter is an [io.Writer] that counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(data []byte) (int, error) {
+	nw, err := c.w.Write(data)
+	c.n += int64(nw)
+	return nw, err
 }
 
 // cacheLoadMemory reads cached headers and body from the memory cache.
 func (s *Server) cacheLoadMemory(hash string) ([]byte, http.Header, error) {
-	e, ok := s.mcache.Get(hash)
+	e, ok := s.memGet(hash)
 	if !ok {
 		return nil, nil, fs.ErrNotExist
+	} else if !time.Now().Before(e.removeAt) {
+		// The entry has outlived its retention, but has not yet been removed
+		// by its expiration or by a sweep.
+		s.memRemove(hash)
+		return nil, nil, fs.ErrNotExist
+	} else if e.stub || e.dueStub(time.Now()) {
+		// Only the header is retained (see RetainMetadataAfterExpiry).
+		s.stubMemory(hash, e)
+		return nil, e.header.Clone(), errHeaderOnly
+	} else if e.onDisk {
+		// The body was demoted; if it is no longer on disk, the entry is
+		// not useful.
+		body, _, err := s.cacheLoadLocal(hash)
+		if err != nil {
+			s.memRemove(hash)
+			return nil, nil, fs.ErrNotExist
+		}
+		e.touch(time.Now())
+		return body, e.header.Clone(), nil
 	}
-	return e.body, e.header, nil
+	e.touch(time.Now())
+	return e.body, e.header.Clone(), nil
 }
 
+// errHeaderOnly is reported by cacheLoadMemory for an entry whose body has
+// been dropped, with the header that is retained.
+var errHeaderOnly = errors.New("only the header is retained")
+
 // cacheStoreMemory writes the contents of body to the memory cache.
-func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.Header, body []byte) {
-	s.mcache.Put(hash, memCacheEntry{
-		header: trimCacheHeader(hdr),
-		body:   body,
+//
+// The entry is removed from the cache after maxAge, or if hot key protection
+// is enabled, after its grace period for stale serving. If it is retained
+// longer for RetainMetadataAfterExpiry, its body is dropped at that point.
+// The extra headers are stored in addition to the usual ones.
+func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.Header, body []byte, extra ...string) {
+	now := time.Now()
+	lifetime := maxAge + s.memoryRetention(hdr)
+	var stubAt time.Time
+	if keep := maxAge + s.RetainMetadataAfterExpiry; keep > lifetime && hasValidator(hdr) {
+		stubAt = now.Add(lifetime)
+		lifetime = keep
+	}
+	removeAt := now.Add(lifetime)
+
+	// Freshness of memory entries is determined from the Date header, so make
+	// sure we have one even if the origin did not send it.
+	mh := s.trimCacheHeader(hdr, extra...)
+	if mh.Get("Date") == "" {
+		mh.Set("Date", now.UTC().Format(http.TimeFormat))
+	}
+	setContentLength(mh, int64(len(body)))
+	var used *atomic.Int64
+	if s.MemoryIdleTimeout > 0 {
+		if lifetime > s.MemoryIdleTimeout {
+			used = s.newIdleTracker(now)
+		}
+		s.idlers.set(hash, used)
+	}
+	s.memPut(hash, memCacheEntry{
+		header:   mh,
+		body:     body,
+		removeAt: removeAt,
+		stubAt:   stubAt,
+		used:     used,
 	})
-	s.expire.After(maxAge, scheddle.Run(func() {
-		s.mcache.Remove(hash)
-	}))
+	s.scheduleExpire(hash, lifetime, removeAt)
+	if !stubAt.IsZero() {
+		s.scheduleStub(hash, stubAt.Sub(now), removeAt)
+	}
+	s.scheduleIdle(hash, used, s.MemoryIdleTimeout)
 }
 
+// keepHeader are the response headers stored with a cached object by default.
 var keepHeader = []string{
-	"Cache-Control", "Content-Type", "Date", "Etag",
+	"Cache-Control", "Content-Encoding", "Content-Range", "Content-Type", "Date",
+	"Etag", "Expires", "Last-Modified", "Location", "Vary",
+}
+
+// hopByHopHeaders are the headers defined by RFC 7230 Section 6.1 as
+// pertaining only to a single connection. These must not be stored in the
+// cache or replayed to clients.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopByHopHeaders removes from h all the hop-by-hop headers, including
+// any headers named by the Connection header.
+//
+// Note that the [net/http/httputil.ReverseProxy] also does this for responses it
+// forwards, and the transport does not reuse a connection after the origin
+// sends "Connection: close". We do it again for objects we store and serve, so
+// that they do not depend on where the headers came from.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
 }
 
-func trimCacheHeader(h http.Header) http.Header {
+// trimCacheHeader returns a copy of h containing only the headers to be
+// stored with a cached object: Those in keepHeader, PreserveHeaders, and
+// extra, less those in DropHeaders. It is applied to objects stored in every
+// tier, so that they are served the same way from each.
+//
+// Content-Length is never copied from h, even if preserved: The length of the
+// stored body is recorded when the object is written (see setContentLength),
+// since the origin may not have sent one, as for a chunked response.
+func (s *Server) trimCacheHeader(h http.Header, extra ...string) http.Header {
+	h = h.Clone()
+	removeHopByHopHeaders(h)
+	h.Del("Content-Length")
 	out := make(http.Header)
-	for _, name := range keepHeader {
+	var hints []string
+	if s.EarlyHints {
+		hints = []string{"Link"}
+	}
+	for _, name := range slices.Concat(keepHeader, s.PreserveHeaders, extra, hints) {
+		if vs := h.Values(name); len(vs) != 0 && !s.dropHeader(name) {
+			out[http.CanonicalHeaderKey(name)] = vs
+		}
+	}
+	for _, name := range []string{statusHeader, fetchTimeHeader, bodyRefHeader, lifetimeHeader} {
 		if v := h.Get(name); v != "" {
 			out.Set(name, v)
 		}
 	}
+	normalizeVary(out)
+	if out.Get("Content-Type") == "" && !s.dropHeader("Content-Type") {
+		out.Set("Content-Type", "application/octet-stream")
+	}
 	return out
 }
 
+// dropHeader reports whether name is one of the DropHeaders. The headers
+// needed to determine freshness are never dropped.
+func (s *Server) dropHeader(name string) bool {
+	if strings.EqualFold(name, "Cache-Control") || strings.EqualFold(name, "Date") {
+		return false
+	}
+	return slices.ContainsFunc(s.DropHeaders, func(drop string) bool {
+		return strings.EqualFold(drop, name)
+	})
+}
+
+// cacheFormatVersion is the version of the cache object format written by
+// writeCacheObject. It is recorded in the header section of each object as
+// X-Cache-Format. Objects without a version are treated as version 1.
+const cacheFormatVersion = 1
+
+// errVersionMismatch is reported by parseCacheObject for objects written with
+// a newer format version than cacheFormatVersion.
+var errVersionMismatch = errors.New("unsupported cache format version")
+
 // parseCacheDbject parses cached object data to extract the body and headers.
+//
+// If the object has a format version newer than cacheFormatVersion, it reports
+// an error wrapping errVersionMismatch, along with the body and headers parsed
+// on a best-effort basis.
 func parseCacheObject(data []byte) ([]byte, http.Header, error) {
 	hdr, rest, ok := bytes.Cut(data, []byte("\n\n"))
 	if !ok {
-		return nil, nil, errors.New("invalid cache object: missing header")
+		return nil, nil, fmt.Errorf("%w: missing header", errCorruptObject)
 	}
+	h, err := parseCacheHeader(string(hdr))
+	return rest, h, err
+}
+
+// parseCacheHeader parses the header section of a cache object, not
+// including the blank line that ends it. If the object has an unsupported
+// format version, it reports an error wrapping errVersionMismatch along with
+// the header.
+func parseCacheHeader(hdr string) (http.Header, error) {
 	h := make(http.Header)
-	for _, line := range strings.Split(string(hdr), "\n") {
+	for _, line := range strings.Split(hdr, "\n") {
 		name, value, ok := strings.Cut(line, ": ")
 		if ok {
 			h.Add(name, value)
 		}
 	}
-	return rest, h, nil
+	if v := h.Get(formatHeader); v != "" {
+		h.Del(formatHeader)
+		if n, err := strconv.Atoi(v); err != nil || n > cacheFormatVersion {
+			return h, fmt.Errorf("%w: %q", errVersionMismatch, v)
+		}
+	}
+	return h, nil
 }
 
 // writeCacheObject writes the specified response data into a cache object at w.
 func writeCacheObject(w io.Writer, h http.Header, body []byte) error {
-	hprintf(w, h, "Content-Type", "application/octet-stream")
-	hprintf(w, h, "Date", "")
-	hprintf(w, h, "Etag", "")
-	fmt.Fprint(w, "\n")
-	_, err := w.Write(body)
+	return writeCacheObjectFrom(w, h, bytesBody(body), nil)
+}
+
+// writeCacheObjectFrom writes the specified response data into a cache object
+// at w, as writeCacheObject, with the body read from body and copied in
+// chunks of buf (see copyStream).
+//
+// The format version is written first, followed by the headers of h in
+// lexicographic order, so that the same object is always serialized the same
+// way. The caller should trim h with trimCacheHeader.
+func writeCacheObjectFrom(w io.Writer, h http.Header, body *bodyBuffer, buf []byte) error {
+	if err := body.Err(); err != nil {
+		return err
+	}
+	h = h.Clone()
+	removeHopByHopHeaders(h)
+	h.Del(formatHeader)
+	h.Del(checksumAlgoHeader)
+	h.Del(checksumHeader)
+	if body.algo == ChecksumSHA256 {
+		h.Set(bodyChecksumHeader, body.Checksum())
+	} else {
+		h.Del(bodyChecksumHeader)
+		h.Set(checksumAlgoHeader, body.algo.String())
+		h.Set(checksumHeader, body.Checksum())
+	}
+	if h.Get(bodyRefHeader) == "" {
+		setContentLength(h, body.Len()) // a shared body is not stored here
+	}
+	writeCacheHeader(w, h)
+	_, err := copyStream(w, body.NewReader(), buf)
 	return err
 }
 
-func hprintf(w io.Writer, h http.Header, name, fallback string) {
-	if v := h.Get(name); v != "" {
-		fmt.Fprintf(w, "%s: %s\n", name, v)
-	} else if fallback != "" {
-		fmt.Fprintf(w, "%s: %s\n", name, fallback)
+// writeCacheHeader writes the header section of a cache object with header h
+// to w, including the blank line that ends it, as writeCacheObjectFrom. The
+// caller should trim h with trimCacheHeader.
+func writeCacheHeader(w io.Writer, h http.Header) {
+	fmt.Fprintf(w, "%s: %d\n", formatHeader, cacheFormatVersion)
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, v)
+		}
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// setContentLength sets the Content-Length of a cached object with header h
+// and a body of n bytes. A 204 response has no Content-Length.
+func setContentLength(h http.Header, n int64) {
+	if cachedStatus(h) == http.StatusNoContent {
+		h.Del("Content-Length")
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(n, 10))
+}
+
+// internalHeader reports whether name is one of the headers used by the
+// cache to manage objects, which are not served to clients.
+func internalHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case http.CanonicalHeaderKey(formatHeader),
+		http.CanonicalHeaderKey(expiresHeader),
+		http.CanonicalHeaderKey(bodyChecksumHeader),
+		http.CanonicalHeaderKey(checksumAlgoHeader),
+		http.CanonicalHeaderKey(checksumHeader),
+		http.CanonicalHeaderKey(statusHeader),
+		http.CanonicalHeaderKey(fetchTimeHeader),
+		http.CanonicalHeaderKey(bodyRefHeader),
+		http.CanonicalHeaderKey(lifetimeHeader):
+		return true
+	}
+	return false
+}
+
+// formatHeader is the name of the header recording the format version of a
+// stored cache object.
+const formatHeader = "X-Cache-Format"
+
+// expiresHeader is the name of the header recording when a stored cache
+// object should no longer be retained.
+const expiresHeader = "X-Cache-Expires"
+
+// withRetention returns a copy of h with its retention deadline set. The
+// object is retained for its freshness lifetime scaled by mult, measured from
+// its Date. If mult is zero or negative, 1 is used. If h has no freshness
+// lifetime, the object is retained indefinitely and h is returned unmodified.
+func withRetention(h http.Header, mult float64) http.Header {
+	lt, ok := freshnessLifetime(h)
+	if !ok {
+		return h
+	}
+	if mult <= 0 {
+		mult = 1
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	out := h.Clone()
+	exp := date.Add(time.Duration(float64(lt) * mult))
+	out.Set(expiresHeader, exp.UTC().Format(http.TimeFormat))
+	return out
+}
+
+// isExpired reports whether a stored object with header h is past its
+// retention deadline as of now.
+func isExpired(h http.Header, now time.Time) bool {
+	exp, err := http.ParseTime(h.Get(expiresHeader))
+	return err == nil && now.After(exp)
+}
+
+// s3RetryDelay is how long to wait before reading an S3 object again, when an
+// invalid object is read with S3ReadValidate enabled.
+const s3RetryDelay = 250 * time.Millisecond
+
+// errChecksumMismatch is reported by validateObject for an object whose body
+// does not match its recorded checksum.
+var errChecksumMismatch = errors.New("body checksum mismatch")
+
+// errCorruptObject is reported by parseCacheObject for data that is not a
+// valid cache object.
+var errCorruptObject = errors.New("invalid cache object")
+
+// errDirectS3 is reported by cacheLoadS3 for an object larger than the
+// DirectS3ServeThreshold. Such objects must be read with cacheOpenS3.
+var errDirectS3 = errors.New("object too large to load")
+
+// readS3Object reads and parses the object for hash from S3.
+func (s *Server) readS3Object(ctx context.Context, hash string) ([]byte, http.Header, error) {
+	rd, err := s.openS3(ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rd.Close()
+	if max := s.DirectS3ServeThreshold; max > 0 && rd.Size() > max {
+		return nil, nil, errDirectS3
+	}
+	data := bytes.NewBuffer(make([]byte, 0, rd.Size()))
+	if _, err := data.ReadFrom(rd); err != nil {
+		return nil, nil, err
+	}
+	return parseCacheObject(data.Bytes())
+}
+
+// readS3Resolved reads and parses the object for hash from S3, as
+// readS3Object, and if its body is shared with another variant, reads the
+// body from the object that holds it.
+func (s *Server) readS3Resolved(ctx context.Context, hash string) ([]byte, http.Header, error) {
+	body, hdr, err := s.readS3Object(ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err = resolveBodyRef(hdr, body, func(ref string) ([]byte, http.Header, error) {
+		return s.readS3Object(ctx, ref)
+	})
+	if err != nil {
+		s.vlogf("[s3] read %q: %v", hash, err)
+		return nil, nil, fs.ErrNotExist
+	}
+	return body, hdr, nil
+}
+
+// cacheOpenS3 opens the object for hash in the remote S3 cache, and reads its
+// header. It returns the header, and a reader for the body of the given size,
+// which the caller must close. It reports fs.ErrNotExist for an expired
+// object, and does not verify the checksum of the body.
+func (s *Server) cacheOpenS3(ctx context.Context, hash string) (http.Header, io.ReadCloser, int64, error) {
+	rd, err := s.openS3(ctx, hash)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	br := bufio.NewReaderSize(rd, s.streamChunkSize())
+	hdr, hlen, err := readCacheHeader(br)
+	if hdr == nil {
+		rd.Close()
+		return nil, nil, 0, err
+	} else if err == nil && isExpired(hdr, time.Now()) {
+		err = fs.ErrNotExist
+	}
+	if _, hdr, err = s.checkVersion(hash, nil, hdr, err, func() error {
+		return s.bucket(hash).Delete(ctx, s.makeKey(hash))
+	}); err != nil {
+		rd.Close()
+		return nil, nil, 0, err
+	}
+	size := rd.Size() - hlen
+	return hdr, copyReader{Reader: br, Closer: rd}, size, nil
+}
+
+// readCacheHeader reads and parses the header section of a cache object from
+// br, leaving br positioned at the start of the body. It returns the header,
+// and the length in bytes of the header section including the blank line that
+// ends it. If the header could be read but has an unsupported format version,
+// it returns the header along with an error wrapping errVersionMismatch.
+func readCacheHeader(br *bufio.Reader) (http.Header, int64, error) {
+	var sb strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid cache object: %w", err)
+		} else if line == "\n" {
+			break
+		}
+		sb.WriteString(line)
+	}
+	hdr, err := parseCacheHeader(strings.TrimSuffix(sb.String(), "\n"))
+	return hdr, int64(sb.Len() + 1), err
+}
+
+// validateObject reports an error if the stored object with header h and
+// body is corrupt, expired, or stale, as of now.
+func validateObject(h http.Header, body []byte, now time.Time) error {
+	if err := checkBody(h, body); err != nil {
+		return err
+	}
+	if isExpired(h, now) {
+		return errors.New("object is expired")
+	} else if !isFresh(h, now) {
+		return errors.New("object is stale")
+	}
+	return nil
+}
+
+// bodyChecksumHeader is the name of the header recording the SHA-256 digest of
+// the body in a stored cache object.
+const bodyChecksumHeader = "X-Cache-Body-SHA256"
+
+// bodyChecksum returns the hex-encoded checksum of body computed by algo. If h
+// records a checksum for the body by the same algorithm, that value is
+// returned instead.
+func bodyChecksum(h http.Header, body []byte, algo ChecksumAlgorithm) string {
+	return storedBodyAs(h, body, algo).Checksum()
+}
+
+// statusHeader is the name of the header recording the status code of a
+// stored cache object, if it is not 200 (OK).
+const statusHeader = "X-Cache-Status"
+
+// withStatus returns h with the status code recorded, if it is not 200.
+func withStatus(h http.Header, code int) http.Header {
+	if code == http.StatusOK {
+		return h
 	}
+	h = h.Clone()
+	h.Set(statusHeader, strconv.Itoa(code))
+	return h
+}
+
+// lifetimeHeader is the name of the header recording the freshness lifetime,
+// in seconds, that the cache assigned to a stored object without an explicit
+// one, as by StatusClassTTL or HeuristicFreshnessMax. It is used in place of a max-age
+// directive, so that the Cache-Control sent to clients is the origin's.
+const lifetimeHeader = "X-Cache-Lifetime"
+
+// fetchTimeHeader is the name of the header recording how long it took to
+// fetch a stored object from the origin, in milliseconds, used for early
+// refresh.
+const fetchTimeHeader = "X-Cache-Fetch-Time"
+
+// isNewerObject reports whether a stored object with header old has a later
+// Date than an object with header h, so that h should not replace it. If
+// either Date is missing or invalid, it reports false.
+func isNewerObject(old, h http.Header) bool {
+	od, err := http.ParseTime(old.Get("Date"))
+	if err != nil {
+		return false
+	}
+	nd, err := http.ParseTime(h.Get("Date"))
+	return err == nil && od.After(nd)
+}
+
+// withFetchTime returns a copy of h with the fetch time d recorded.
+func withFetchTime(h http.Header, d time.Duration) http.Header {
+	h = h.Clone()
+	h.Set(fetchTimeHeader, strconv.FormatInt(max(d.Milliseconds(), 1), 10))
+	return h
+}
+
+// fetchTime returns the fetch time recorded in h, or 0 if it is not known.
+func fetchTime(h http.Header) time.Duration {
+	ms, err := strconv.ParseInt(h.Get(fetchTimeHeader), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// cachedStatus returns the status code of a stored object with header h.
+func cachedStatus(h http.Header) int {
+	if code, err := strconv.Atoi(h.Get(statusHeader)); err == nil {
+		return code
+	}
+	return http.StatusOK
 }
 
 // setXCacheInfo adds cache-specific headers to h.
@@ -161,10 +857,139 @@ func setXCacheInfo(h http.Header, result, hash string) {
 	}
 }
 
+// memoryRetention returns how long a memory cache entry with header hdr
+// should be retained with its body after it expires, for stale serving.
+func (s *Server) memoryRetention(hdr http.Header) time.Duration {
+	d := s.hotKeyMaxStale()
+	if cc := parseCacheControl(hdr.Get("Cache-Control")); cc.StaleIfError > d {
+		d = cc.StaleIfError
+	}
+	return d
+}
+
 // memCacheEntry is the format of entries in the memory cache.
 type memCacheEntry struct {
-	header http.Header
-	body   []byte
+	header   http.Header
+	body     []byte
+	removeAt time.Time     // when the entry is due to be removed
+	stubAt   time.Time     // when the body is due to be dropped, if ever
+	onDisk   bool          // the body was demoted to the local cache
+	stub     bool          // the body was dropped, and only the header kept
+	used     *atomic.Int64 // time of last use (ns), if MemoryIdleTimeout is set
+}
+
+// dueStub reports whether the body of e is due to be dropped as of now.
+func (e memCacheEntry) dueStub(now time.Time) bool {
+	return !e.stub && !e.stubAt.IsZero() && !now.Before(e.stubAt)
+}
+
+// memoryPressureInterval is the minimum interval between calls to the
+// MemoryPressureCheck callback.
+const memoryPressureInterval = 1 * time.Second
+
+// checkMemoryPressure calls MemoryPressureCheck, if it is set and has not
+// been called recently, and if it reports memory pressure, evicts all entries
+// from the memory cache.
+func (s *Server) checkMemoryPressure(now time.Time) {
+	if s.MemoryPressureCheck == nil {
+		return
+	}
+	last := s.lastPressureCheck.Load()
+	if now.UnixNano()-last < int64(memoryPressureInterval) ||
+		!s.lastPressureCheck.CompareAndSwap(last, now.UnixNano()) {
+		return // checked recently, or another request is checking
+	}
+	if s.MemoryPressureCheck() {
+		n, size := s.mcache.Len(), s.mcache.Size()
+		s.mcache.Clear()
+		s.memPressureEvict.Add(int64(n))
+		s.logf("memory pressure: evicted %d entries (%d bytes) from memory cache", n, size)
+	}
+}
+
+// removalSet records the keys of memory cache entries being removed or
+// replaced explicitly, so that evictMemory can tell them apart from entries
+// evicted to make room.
+type removalSet struct {
+	mu   sync.Mutex
+	keys map[string]int
+}
+
+func (r *removalSet) begin(hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys == nil {
+		r.keys = make(map[string]int)
+	}
+	r.keys[hash]++
+}
+
+func (r *removalSet) end(hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys[hash]--; r.keys[hash] <= 0 {
+		delete(r.keys, hash)
+	}
+}
+
+func (r *removalSet) has(hash string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[hash] > 0
+}
+
+// lruRemove removes the entry for hash from the LRU memory cache. The entry
+// is not demoted by BodyEvictFirst.
+func (s *Server) lruRemove(hash string) {
+	s.removals.begin(hash)
+	defer s.removals.end(hash)
+	s.mcache.Remove(hash)
+}
+
+// lruPut stores e as the entry for hash in the LRU memory cache. An entry it
+// replaces is not demoted by BodyEvictFirst, though entries evicted to make
+// room for e may be.
+func (s *Server) lruPut(hash string, e memCacheEntry) {
+	s.removals.begin(hash)
+	defer s.removals.end(hash)
+	s.mcache.Put(hash, e)
+}
+
+// evictMemory is called when an entry is removed from the memory cache, with
+// the cache locked. If BodyEvictFirst is enabled, and the entry was evicted
+// to make room or for memory pressure, rather than removed or replaced
+// explicitly, its body is demoted to the local cache.
+func (s *Server) evictMemory(hash string, e memCacheEntry) {
+	if e.onDisk || len(e.body) == 0 || s.removals.has(hash) {
+		return
+	}
+	go s.demoteBody(hash, e)
+}
+
+// demoteBody writes the body of the memory cache entry e to the local cache,
+// and replaces e in the memory cache with its metadata. It does nothing if e
+// has expired or been replaced, so that only entries evicted to make room are
+// demoted.
+func (s *Server) demoteBody(hash string, e memCacheEntry) {
+	if !time.Now().Before(e.removeAt) || s.memHas(hash) || !s.diskAvailable() {
+		return
+	}
+	if err := s.cacheStoreLocal(hash, e.header, e.body); err != nil {
+		s.logf("demote %q to local: %v", hash, err)
+		return
+	}
+	s.rspDemoteMem.Add(1)
+	s.memPut(hash, memCacheEntry{header: e.header, removeAt: e.removeAt, onDisk: true, used: e.used})
+}
+
+// stubMemory replaces the memory cache entry e for hash with one that holds
+// only its header, once its body is no longer retained (see
+// RetainMetadataAfterExpiry). It does nothing if e is already a stub.
+func (s *Server) stubMemory(hash string, e memCacheEntry) {
+	if e.stub {
+		return
+	}
+	s.memPut(hash, memCacheEntry{header: e.header, removeAt: e.removeAt, stub: true, used: e.used})
 }
 
 func entrySize(e memCacheEntry) int64 { return int64(len(e.body)) }
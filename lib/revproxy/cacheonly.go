@@ -0,0 +1,38 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// isOnlyIfCached reports whether r has the only-if-cached request directive
+// (RFC 9111 Section 5.2.1.7), so that it must not be forwarded to the origin.
+func isOnlyIfCached(r *http.Request) bool {
+	return parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("only-if-cached")
+}
+
+// serveOnlyIfCachedMiss writes the response to an only-if-cached request r for
+// the object with hash, which could not be served from the cache, according
+// to OnlyIfCachedMissStatus and OnlyIfCachedMissBody.
+func (s *Server) serveOnlyIfCachedMiss(w http.ResponseWriter, r *http.Request, hash string) {
+	s.reqCacheOnlyMiss.Add(1)
+	traceOf(r).add("only-if-cached", "miss", time.Time{})
+	code := s.OnlyIfCachedMissStatus
+	if code < 100 || code > 999 {
+		code = http.StatusGatewayTimeout
+	}
+	body := s.OnlyIfCachedMissBody
+	if body == nil {
+		body = []byte(http.StatusText(code) + "\n")
+	}
+	setXCacheInfo(w.Header(), "miss, only-if-cached", hash)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	w.Write(body)
+	s.vlogf("rp E H:%s miss only-if-cached S:%d", hash, code)
+}
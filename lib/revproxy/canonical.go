@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// keyURL returns the URL used to compute the cache key for a request to u:
+// u with the CanonicalHost substituted, if set, and then each of the
+// Canonicalizers applied in order. The original u is not modified.
+func (s *Server) keyURL(u *url.URL) *url.URL {
+	if (s.CanonicalHost == "" || u.Host == "") && len(s.Canonicalizers) == 0 {
+		return u
+	}
+	cu := *u
+	if s.CanonicalHost != "" && cu.Host != "" {
+		cu.Host = s.CanonicalHost
+	}
+	for _, canon := range s.Canonicalizers {
+		canon(&cu)
+	}
+	return &cu
+}
+
+// SortQuery is a canonicalizer for [Server.Canonicalizers] that sorts the
+// query parameters of a URL by name, so that requests that differ only in the
+// order of their parameters share a cache entry. The order of values for the
+// same name is kept. Parameters that cannot be parsed are discarded.
+func SortQuery(u *url.URL) {
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+}
+
+// DropQueryParams returns a canonicalizer for [Server.Canonicalizers] that
+// removes the query parameters with the given names from a URL, for example
+// tracking parameters that do not affect the response. The order of the
+// remaining parameters is kept.
+func DropQueryParams(names ...string) func(*url.URL) {
+	return func(u *url.URL) {
+		if u.RawQuery == "" {
+			return
+		}
+		parts := strings.Split(u.RawQuery, "&")
+		parts = slices.DeleteFunc(parts, func(p string) bool {
+			name, _, _ := strings.Cut(p, "=")
+			if un, err := url.QueryUnescape(name); err == nil {
+				name = un
+			}
+			return slices.Contains(names, name)
+		})
+		u.RawQuery = strings.Join(parts, "&")
+	}
+}
+
+// LowercaseHost is a canonicalizer for [Server.Canonicalizers] that converts
+// the host of a URL to lower case, since host names are not case sensitive.
+func LowercaseHost(u *url.URL) { u.Host = strings.ToLower(u.Host) }
+
+// StripTrailingSlash is a canonicalizer for [Server.Canonicalizers] that
+// removes a trailing slash from the path of a URL, other than the root path,
+// so that "/a/b/" and "/a/b" share a cache entry. Use it only if the origin
+// serves the same content for both.
+func StripTrailingSlash(u *url.URL) {
+	if len(u.Path) > 1 && strings.HasSuffix(u.Path, "/") {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	}
+}
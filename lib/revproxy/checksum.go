@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+)
+
+// ChecksumAlgorithm is an algorithm used to record the integrity of the body
+// of a stored cache object (see [Server.ChecksumPolicy]).
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumSHA256 records a SHA-256 digest of the body (the default).
+	ChecksumSHA256 ChecksumAlgorithm = iota
+
+	// ChecksumCRC32C records a CRC-32 checksum of the body, with the
+	// Castagnoli polynomial. It is much cheaper to compute than SHA-256, and
+	// detects accidental corruption, but not deliberate tampering.
+	ChecksumCRC32C
+)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case ChecksumSHA256:
+		return "sha256"
+	case ChecksumCRC32C:
+		return "crc32c"
+	}
+	return fmt.Sprintf("ChecksumAlgorithm(%d)", int(a))
+}
+
+const (
+	// checksumAlgoHeader is the name of the header recording the algorithm
+	// used for the body checksum of a stored cache object, if it is not
+	// SHA-256. The checksum itself is recorded as checksumHeader.
+	checksumAlgoHeader = "X-Cache-Body-Checksum-Algo"
+
+	// checksumHeader is the name of the header recording the body checksum of
+	// a stored cache object, when it is computed by the algorithm named by
+	// checksumAlgoHeader rather than SHA-256 (see bodyChecksumHeader).
+	checksumHeader = "X-Cache-Body-Checksum"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumAlgorithm returns the algorithm ChecksumPolicy chooses for an object
+// with header h and a body of size bytes, or -1 if the size is not known.
+func (s *Server) checksumAlgorithm(h http.Header, size int64) ChecksumAlgorithm {
+	if s.ChecksumPolicy == nil {
+		return ChecksumSHA256
+	}
+	return s.ChecksumPolicy(h.Get("Content-Type"), size)
+}
+
+// objectBody returns an in-memory bodyBuffer containing data, the body of an
+// object with header h to be stored, with its checksum computed by the
+// algorithm chosen by ChecksumPolicy. A checksum recorded in h by the same
+// algorithm is used rather than being computed again.
+func (s *Server) objectBody(h http.Header, data []byte) *bodyBuffer {
+	return storedBodyAs(h, data, s.checksumAlgorithm(h, int64(len(data))))
+}
+
+// recordedChecksum returns the body checksum recorded in the header h of a
+// stored cache object, if it was computed by algo, or else "".
+func recordedChecksum(h http.Header, algo ChecksumAlgorithm) string {
+	if h.Get(checksumAlgoHeader) != "" {
+		if h.Get(checksumAlgoHeader) != algo.String() {
+			return ""
+		}
+		return h.Get(checksumHeader)
+	} else if algo == ChecksumSHA256 {
+		return h.Get(bodyChecksumHeader)
+	}
+	return ""
+}
+
+// writeObject writes a cache object with header h and the contents of body to
+// w, as writeCacheObjectFrom, streaming the body in chunks of StreamChunkSize.
+func (s *Server) writeObject(w io.Writer, h http.Header, body *bodyBuffer) error {
+	return writeCacheObjectFrom(w, h, body, make([]byte, s.streamChunkSize()))
+}
+
+// checkBody reports an error wrapping errChecksumMismatch if body does not
+// match the checksum recorded in the header h of a stored cache object. An
+// object without a recorded checksum is not checked.
+func checkBody(h http.Header, body []byte) error {
+	var got, want string
+	switch algo := h.Get(checksumAlgoHeader); algo {
+	case "":
+		if want = h.Get(bodyChecksumHeader); want == "" {
+			return nil
+		}
+		got = bytesBody(body).Checksum()
+	case ChecksumCRC32C.String():
+		want = h.Get(checksumHeader)
+		got = fmt.Sprintf("%08x", crc32.Checksum(body, crc32c))
+	default:
+		return fmt.Errorf("unknown checksum algorithm %q", algo)
+	}
+	if got != want {
+		return fmt.Errorf("%w: got %s, want %s", errChecksumMismatch, got, want)
+	}
+	return nil
+}
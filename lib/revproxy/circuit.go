@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bounds on how long the proxy waits between attempts to reach an origin
+// whose error rate has exceeded OriginErrorThreshold.
+const (
+	minOriginBackoff = 1 * time.Second
+	maxOriginBackoff = 1 * time.Minute
+)
+
+// originHealth tracks the error rate of requests to the origin, to decide
+// when to stop sending it requests.
+//
+// Errors are counted in windows of one second. When the count in the current
+// window reaches the threshold, the circuit opens, and requests are not sent
+// to the origin until the backoff period has elapsed. After that, a single
+// request is let through as a probe: If it succeeds the circuit closes, and
+// otherwise the backoff period doubles, up to a limit.
+type originHealth struct {
+	mu      sync.Mutex
+	window  time.Time // start of the current window
+	errors  int       // errors in the current window
+	open    bool      // whether the circuit is open
+	backoff time.Duration
+	retryAt time.Time // when to next let a request through (if open)
+}
+
+// originAvailable reports whether a request may be sent to the origin at time
+// now. If not, it also reports how long until the next attempt. If the
+// circuit is disabled, it always reports true.
+func (s *Server) originAvailable(now time.Time) (bool, time.Duration) {
+	if s.OriginErrorThreshold <= 0 {
+		return true, 0
+	}
+	o := &s.origin
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.open {
+		return true, 0
+	} else if wait := o.retryAt.Sub(now); wait > 0 {
+		return false, wait
+	}
+
+	// The backoff has elapsed: Let this request through as a probe, and hold
+	// off the others until it reports back (or until the backoff elapses
+	// again, in case it never does).
+	o.retryAt = now.Add(o.backoff)
+	return true, 0
+}
+
+// recordOrigin records the outcome of a request to the origin at time now.
+// If the circuit is disabled, it does nothing.
+func (s *Server) recordOrigin(failed bool, now time.Time) {
+	if s.OriginErrorThreshold <= 0 {
+		return
+	}
+	o := &s.origin
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !failed {
+		if o.open {
+			o.open = false
+			s.logf("origin recovered, resuming normal requests")
+		}
+		return
+	} else if o.open {
+		o.backoff = min(2*o.backoff, maxOriginBackoff)
+		o.retryAt = now.Add(o.backoff)
+		return
+	}
+
+	if now.Sub(o.window) >= time.Second {
+		o.window = now
+		o.errors = 0
+	}
+	o.errors++
+	if float64(o.errors) >= s.OriginErrorThreshold {
+		o.open = true
+		o.backoff = minOriginBackoff
+		o.retryAt = now.Add(o.backoff)
+		s.reqOriginTrip.Add(1)
+		s.logf("origin error rate exceeded, serving from cache only")
+	}
+}
+
+// serveDegraded serves r while the origin is unavailable. If there is a stale
+// cached copy of the object, it is served with warnings. Otherwise, the
+// request fails with 503 (Service Unavailable), and a Retry-After header
+// giving the time until the origin will next be tried.
+func (s *Server) serveDegraded(w http.ResponseWriter, r *http.Request, hash string, stale *memCacheEntry, wait time.Duration, start time.Time) {
+	traceOf(r).addf("origin", time.Time{}, "unavailable, retry in %v", wait)
+	if stale == nil {
+		s.reqOriginBackoff.Add(1)
+		secs := int((wait + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		s.vlogf("rp E H:%s backoff (%v elapsed)", hash, time.Since(start))
+		return
+	}
+	s.reqOriginStale.Add(1)
+	setXCacheInfo(stale.header, "hit, stale", hash)
+	stale.header.Add("Warning", warnStale)
+	stale.header.Add("Warning", warnDisconnected)
+	s.writeCachedResponse(w, r, stale.header, stale.body)
+	s.vlogf("rp E H:%s hit stale B:%d (%v elapsed)", hash, len(stale.body), time.Since(start))
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flightGroup tracks fetches from the origin in progress, so that concurrent
+// requests for the same object can share the result of a single fetch.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// A flight is a fetch from the origin in progress. The leader of the flight
+// holds it as a token, which identifies the fetch to endFlight and
+// abandonFlight.
+type flight struct {
+	done      chan struct{} // closed when the fetch ends or is abandoned
+	abandoned bool          // the followers were released to fetch independently
+}
+
+type flightKey struct{}
+
+// withFlight returns a copy of r carrying f, the flight r leads.
+func withFlight(r *http.Request, f *flight) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), flightKey{}, f))
+}
+
+// flightOf returns the flight r leads, or nil if it does not lead one.
+func flightOf(r *http.Request) *flight {
+	f, _ := r.Context().Value(flightKey{}).(*flight)
+	return f
+}
+
+// defaultMaxCoalesceBodyBytes is the default limit on the size of an object
+// whose concurrent fetches are coalesced.
+const defaultMaxCoalesceBodyBytes = 64 << 20
+
+// joinFlight coalesces concurrent fetches of the object for hash.
+//
+// If no fetch for hash is in progress, the caller becomes the leader:
+// joinFlight returns a new flight, which the caller must pass to endFlight
+// when its fetch is complete and the cache has been updated.
+//
+// Otherwise, the caller is a follower: joinFlight waits for the leader to
+// finish, and returns nil, true. If ctx ends, or the follower waits longer
+// than CoalesceTimeout, joinFlight gives up and returns nil, false; the
+// caller should then fetch the object independently. It does the same if the
+// leader abandons the flight (see abandonFlight).
+func (s *Server) joinFlight(ctx context.Context, hash string) (lead *flight, leaderDone bool) {
+	g := &s.flights
+	g.mu.Lock()
+	f, ok := g.m[hash]
+	if !ok {
+		if g.m == nil {
+			g.m = make(map[string]*flight)
+		}
+		f = &flight{done: make(chan struct{})}
+		g.m[hash] = f
+		g.mu.Unlock()
+		return f, false
+	}
+	g.mu.Unlock()
+
+	s.reqCoalesced.Add(1)
+	var timeout <-chan time.Time
+	if s.CoalesceTimeout > 0 {
+		t := time.NewTimer(s.CoalesceTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-f.done:
+		if f.abandoned {
+			s.reqCoalesceLarge.Add(1)
+			return nil, false
+		}
+		return nil, true
+	case <-timeout:
+		s.reqCoalesceTimeout.Add(1)
+		s.vlogf("rp - H:%s coalesce timeout", hash)
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// endFlight ends the flight f for hash, led by the caller, and wakes its
+// followers, unless it was abandoned.
+func (s *Server) endFlight(hash string, f *flight) {
+	g := &s.flights
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !f.abandoned {
+		delete(g.m, hash)
+		close(f.done)
+	}
+}
+
+// abandonFlight releases the requests waiting on the flight f for hash, led
+// by the caller, to fetch the object independently, if its response rsp is
+// larger than MaxCoalesceBodyBytes. Requests for hash that arrive later begin
+// a new flight. It does nothing if f is nil, or is no longer the flight in
+// progress for hash, so that a fetch outside the flight, such as a background
+// refresh, cannot release the followers of another.
+func (s *Server) abandonFlight(hash string, f *flight, rsp *http.Response) {
+	if f == nil {
+		return
+	}
+	max := s.MaxCoalesceBodyBytes
+	if max == 0 {
+		max = defaultMaxCoalesceBodyBytes
+	}
+	if max < 0 || rsp.ContentLength <= max {
+		return
+	}
+	g := &s.flights
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.m[hash] == f {
+		f.abandoned = true
+		delete(g.m, hash)
+		close(f.done)
+		s.vlogf("rp - H:%s coalesce abandoned: B:%d", hash, rsp.ContentLength)
+	}
+}
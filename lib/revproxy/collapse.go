@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/creachadair/mds/cache"
+)
+
+// bodyRefHeader is the name of the header recording, in a stored cache object
+// whose body is shared with another variant of the same URL, the cache key of
+// the object that holds the body.
+const bodyRefHeader = "X-Cache-Body-Ref"
+
+// variantIndexSize is the number of URLs for which the most recently stored
+// variant is remembered by CollapseIdenticalVariants.
+const variantIndexSize = 4096
+
+// storedVariant records a variant stored in the local cache.
+type storedVariant struct {
+	hash string // cache key of the variant
+	sum  string // checksum of its body
+}
+
+// variantBase returns the key identifying the group of variants to which r
+// belongs: the cache key of its URL alone, without the other parts of the
+// request that may contribute to its own key.
+func (s *Server) variantBase(r *http.Request) string {
+	return hashRequestURL(s.keyURL(r.URL))
+}
+
+// collapseVariant reports whether the object for hash, a response to r with
+// the given body, has the same body as another variant of the same URL that
+// is stored in the local cache. If so, it returns the key of that variant, to
+// be recorded in place of the body. Otherwise, it records the object as the
+// latest variant for its URL, and returns "".
+func (s *Server) collapseVariant(r *http.Request, hash string, body *bodyBuffer) string {
+	if !s.CollapseIdenticalVariants {
+		return ""
+	} else if max := s.DirectS3ServeThreshold; max > 0 && body.Len() > max {
+		return "" // the shared body would be streamed, and cannot be resolved
+	} else if body.algo != ChecksumSHA256 {
+		return "" // shared bodies are identified by their SHA-256 digest
+	}
+	s.initVariantIndex.Do(func() {
+		s.variantIndex = cache.New(cache.LRU[string, storedVariant](variantIndexSize))
+	})
+	base, sum := s.variantBase(r), body.Checksum()
+	if v, ok := s.variantIndex.Get(base); ok && v.hash != hash && v.sum == sum {
+		if _, hdr, err := s.readLocalObject(v.hash); err == nil && hdr.Get(bodyChecksumHeader) == sum && hdr.Get(bodyRefHeader) == "" {
+			s.rspCollapsed.Add(1)
+			s.rspCollapsedBytes.Add(body.Len())
+			return v.hash
+		}
+	}
+	s.variantIndex.Put(base, storedVariant{hash: hash, sum: sum})
+	return ""
+}
+
+// refBody returns a bodyBuffer with no contents, that records the checksum of
+// the shared body for an object whose body is held by another variant.
+func refBody(sum string) *bodyBuffer { return &bodyBuffer{known: sum} }
+
+// resolveBodyRef returns the body for an object with header hdr and the
+// given stored body. If hdr records that the body is held by another object,
+// it is loaded with load, and checked against the checksum recorded in hdr.
+func resolveBodyRef(hdr http.Header, body []byte, load func(hash string) ([]byte, http.Header, error)) ([]byte, error) {
+	ref := hdr.Get(bodyRefHeader)
+	if ref == "" {
+		return body, nil
+	}
+	rbody, rhdr, err := load(ref)
+	if err != nil {
+		return nil, err
+	} else if rhdr.Get(bodyRefHeader) != "" {
+		return nil, fmt.Errorf("shared body %q is itself shared: %w", ref, os.ErrNotExist)
+	}
+	want := hdr.Get(bodyChecksumHeader)
+	if got := storedBody(rhdr, rbody).Checksum(); got != want {
+		return nil, fmt.Errorf("shared body %q has checksum %s, want %s: %w", ref, got, want, os.ErrNotExist)
+	}
+	return rbody, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// corsHeaders are the response headers stored with a cached preflight
+// response, in addition to the usual ones.
+var corsHeaders = []string{
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Private-Network",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+	"Vary",
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r != nil && r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflightKey returns the parts of a preflight request r that select its
+// response, to be included in its cache key. This is the equivalent of the
+// response varying on these headers.
+func preflightKey(r *http.Request) []string {
+	var reqHeaders []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				reqHeaders = append(reqHeaders, name)
+			}
+		}
+	}
+	slices.Sort(reqHeaders)
+	return []string{
+		"Method: " + r.Method,
+		"Origin: " + r.Header.Get("Origin"),
+		"Access-Control-Request-Method: " + r.Header.Get("Access-Control-Request-Method"),
+		"Access-Control-Request-Headers: " + strings.Join(slices.Compact(reqHeaders), ","),
+	}
+}
+
+// setAllowOrigin sets the Access-Control-Allow-Origin header h of a response
+// to r, according to CORSOrigins: If the Origin of r is allowed, it is
+// reflected, otherwise the header is removed, whatever value was cached. Since
+// the result depends on the request Origin, "Vary: Origin" is added.
+//
+// Preflight responses are left alone: Their cache keys include the Origin, so
+// the allowed origin cached with them is already specific to the request.
+func (s *Server) setAllowOrigin(r *http.Request, h http.Header) {
+	if isPreflight(r) {
+		return
+	}
+	h.Del("Access-Control-Allow-Origin")
+	addVary(h, "Origin")
+	origin := r.Header.Get("Origin")
+	if origin != "" && slices.ContainsFunc(s.CORSOrigins, func(allow string) bool {
+		return allow == "*" || strings.EqualFold(allow, origin)
+	}) {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// canCachePreflight reports whether the preflight response rsp can be cached
+// in memory, and if so for how long. The lifetime is given by max-age if the
+// response has one, and otherwise by Access-Control-Max-Age, up to one hour.
+func canCachePreflight(rsp *http.Response) (time.Duration, bool) {
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusNoContent {
+		return 0, false
+	}
+	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
+	if cc.Keys.Has("no-store") || cc.Keys.Has("no-cache") {
+		return 0, false
+	}
+	maxAge := cc.MaxAge
+	if !cc.Keys.Has("max-age") {
+		maxAge = parseSeconds(rsp.Header.Get("Access-Control-Max-Age"), 0)
+	}
+	if maxAge <= 0 {
+		return 0, false
+	}
+	return min(maxAge, time.Hour), true
+}
+
+// preflightHeader returns the header to store for a preflight response with
+// header h, to be cached for maxAge. Since freshness is determined from the
+// Cache-Control header, one is added if needed.
+func preflightHeader(h http.Header, maxAge time.Duration) http.Header {
+	if parseCacheControl(h.Get("Cache-Control")).Keys.Has("max-age") {
+		return h
+	}
+	h = h.Clone()
+	h.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	return h
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"cmp"
+	"fmt"
+
+	"github.com/creachadair/mds/heapq"
+)
+
+// costStore is an implementation of the [cache.Store] interface for memory
+// cache entries, that evicts entries by the GreedyDual-Size policy: Each entry
+// has a priority of L + cost/size, where the cost is the time taken to fetch
+// it from the origin, and L is the priority of the last entry evicted. The
+// entry with the lowest priority is evicted first, so entries that are
+// expensive to fetch for their size are kept longer. Since L rises as entries
+// are evicted, and an access resets the priority of an entry as of the
+// current L, entries that are not used eventually age out, however costly.
+//
+// Entries with the same priority are evicted in least-recently used order.
+type costStore struct {
+	present   map[string]int // :: key → offset in queue
+	queue     *heapq.Queue[costEntry]
+	inflation float64 // L, the priority of the last entry evicted
+	clock     int64
+}
+
+type costEntry struct {
+	prio  float64
+	seq   int64 // logical time of last access, to break ties
+	key   string
+	value memCacheEntry
+}
+
+func compareCost(a, b costEntry) int {
+	if c := cmp.Compare(a.prio, b.prio); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.seq, b.seq)
+}
+
+func newCostStore() *costStore {
+	c := &costStore{
+		present: make(map[string]int),
+		queue:   heapq.New(compareCost),
+	}
+	c.queue.Update(func(e costEntry, pos int) { c.present[e.key] = pos })
+	return c
+}
+
+// entryCost returns the cost per byte of fetching the memory cache entry e,
+// in milliseconds of fetch time. Entries without a recorded fetch time are
+// treated as costing 1ms.
+func entryCost(e memCacheEntry) float64 {
+	cost := max(fetchTime(e.header).Milliseconds(), 1)
+	return float64(cost) / float64(max(len(e.body), 1))
+}
+
+// Check implements part of the [cache.Store] interface.
+func (c *costStore) Check(key string) (memCacheEntry, bool) {
+	pos, ok := c.present[key]
+	if !ok {
+		return memCacheEntry{}, false
+	}
+	e, ok := c.queue.Peek(pos)
+	return e.value, ok
+}
+
+// Access implements part of the [cache.Store] interface.
+func (c *costStore) Access(key string) (memCacheEntry, bool) {
+	pos, ok := c.present[key]
+	if !ok {
+		return memCacheEntry{}, false
+	}
+	c.clock++
+	e, _ := c.queue.Remove(pos) // cannot fail
+	e.prio = c.inflation + entryCost(e.value)
+	e.seq = c.clock
+	c.queue.Add(e)
+	return e.value, true
+}
+
+// Store implements part of the [cache.Store] interface.
+func (c *costStore) Store(key string, val memCacheEntry) {
+	if _, ok := c.present[key]; ok {
+		panic(fmt.Sprintf("cost store: unexpected key %v", key))
+	}
+	c.clock++
+	c.present[key] = c.queue.Add(costEntry{
+		prio:  c.inflation + entryCost(val),
+		seq:   c.clock,
+		key:   key,
+		value: val,
+	})
+}
+
+// Remove implements part of the [cache.Store] interface.
+func (c *costStore) Remove(key string) {
+	if pos, ok := c.present[key]; ok {
+		c.queue.Remove(pos)
+		delete(c.present, key)
+	}
+}
+
+// Evict implements part of the [cache.Store] interface.
+func (c *costStore) Evict() (string, memCacheEntry) {
+	e, ok := c.queue.Pop()
+	if !ok {
+		panic("cost evict: no entries left")
+	}
+	delete(c.present, e.key)
+	c.inflation = e.prio
+	return e.key, e.value
+}
@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creachadair/scheddle"
+)
+
+// defaultDiskProbeInterval is the default interval between probes of a local
+// cache that was disabled due to errors.
+const defaultDiskProbeInterval = 30 * time.Second
+
+// errDiskDisabled is reported by an attempt to store an object in the local
+// cache while it is disabled due to errors (see DiskErrorThreshold).
+var errDiskDisabled = errors.New("local cache disabled")
+
+// diskHealth tracks the rate of I/O errors from the local cache, to decide
+// when to stop using it.
+//
+// Errors are counted in windows of one second. When the count in the current
+// window reaches the threshold, the local cache is disabled, and a probe is
+// scheduled to test whether it has recovered.
+type diskHealth struct {
+	mu       sync.Mutex
+	window   time.Time // start of the current window
+	errors   int       // errors in the current window
+	disabled bool
+}
+
+// diskAvailable reports whether the local cache may be used.
+func (s *Server) diskAvailable() bool {
+	if s.DiskErrorThreshold <= 0 {
+		return true
+	}
+	d := &s.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.disabled
+}
+
+// recordDisk records an error err from the local cache. Errors reporting that
+// an object does not exist are not counted. If the error rate reaches
+// DiskErrorThreshold, the local cache is disabled.
+func (s *Server) recordDisk(err error) {
+	if s.DiskErrorThreshold <= 0 || err == nil || errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	s.diskError.Add(1)
+	d := &s.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.disabled {
+		return
+	}
+	now := time.Now()
+	if now.Sub(d.window) >= time.Second {
+		d.window = now
+		d.errors = 0
+	}
+	d.errors++
+	if float64(d.errors) >= s.DiskErrorThreshold {
+		d.disabled = true
+		s.diskTrip.Add(1)
+		s.logf("local cache error rate exceeded (last error: %v), continuing without it", err)
+		s.scheduleDiskProbe()
+	}
+}
+
+// scheduleDiskProbe schedules a probe of the disabled local cache.
+func (s *Server) scheduleDiskProbe() {
+	d := s.DiskProbeInterval
+	if d <= 0 {
+		d = defaultDiskProbeInterval
+	}
+	s.expire.After(d, scheddle.Run(func() {
+		s.start(func() error {
+			if err := s.probeDisk(); err != nil {
+				s.vlogf("local cache probe: %v", err)
+				s.scheduleDiskProbe()
+				return nil
+			}
+			d := &s.disk
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.disabled, d.errors = false, 0
+			s.logf("local cache recovered, resuming use")
+			return nil
+		})
+	}))
+}
+
+// probeDisk reports whether a file can be written, read back, and removed in
+// the local cache directory.
+func (s *Server) probeDisk() error {
+	f, err := os.CreateTemp(s.Local, ".probe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	want := []byte("probe")
+	_, err = f.Write(want)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	} else if !bytes.Equal(got, want) {
+		return fmt.Errorf("read back %q, want %q", got, want)
+	}
+	return os.Remove(f.Name())
+}
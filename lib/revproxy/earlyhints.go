@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// maxHintPrefetch is the maximum number of preload links prefetched for a
+// single Early Hints response.
+const maxHintPrefetch = 8
+
+// maxHintBatches is the maximum number of Early Hints responses whose links
+// are prefetched at once. Hints that arrive while this many are in progress
+// are dropped.
+const maxHintBatches = 4
+
+type hintPrefetchKey struct{}
+
+// watchEarlyHints arranges for the preload links of any 103 (Early Hints)
+// response to the outbound request of pr to be prefetched into the cache.
+// The hints are relayed to the client by the reverse proxy itself. Requests
+// that were themselves issued to prefetch hints are not watched, so hints do
+// not cascade.
+func (s *Server) watchEarlyHints(pr *httputil.ProxyRequest) {
+	if pr.In.Context().Value(hintPrefetchKey{}) != nil {
+		return
+	}
+	base := *pr.In.URL
+	base.Host = pr.In.Host
+	if base.Scheme == "" {
+		base.Scheme = "https"
+	}
+	ctx := httptrace.WithClientTrace(pr.Out.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				s.prefetchHints(&base, preloadLinks(h.Values("Link")))
+			}
+			return nil
+		},
+	})
+	pr.Out = pr.Out.WithContext(ctx)
+}
+
+// prefetchHints requests the given link targets, resolved relative to base,
+// through the cache in the background. Links to hosts that are not Targets
+// are skipped.
+//
+// This is called from the response callback of an origin request, so it must
+// not block: Prefetches run outside the shared task group, whose slots may all
+// be held by requests waiting for this one, and if maxHintBatches are already
+// in progress, the links are dropped.
+func (s *Server) prefetchHints(base *url.URL, links []string) {
+	if len(links) > maxHintPrefetch {
+		links = links[:maxHintPrefetch]
+	}
+	var urls []string
+	for _, link := range links {
+		u, err := base.Parse(link)
+		if err != nil || !hostMatchesTarget(u.Host, s.Targets) {
+			continue
+		}
+		urls = append(urls, u.String())
+	}
+	if len(urls) == 0 {
+		return
+	} else if s.hints.Add(1) > maxHintBatches {
+		s.hints.Add(-1)
+		s.vlogf("early hints: dropped %d links, too many prefetches", len(urls))
+		return
+	}
+	go func() {
+		defer s.hints.Add(-1)
+		ctx := context.WithValue(context.Background(), hintPrefetchKey{}, true)
+		lim := s.newWarmLimiter()
+		for _, u := range urls {
+			s.reqHintPrefetch.Add(1)
+			if err := s.warmOne(ctx, lim, u); err != nil {
+				break
+			}
+		}
+	}()
+}
+
+// sendEarlyHints sends a 103 (Early Hints) response to w carrying the preload
+// links from the cached response header hdr, if there are any and the client
+// can accept it.
+func (s *Server) sendEarlyHints(w http.ResponseWriter, r *http.Request, hdr http.Header) {
+	if !s.EarlyHints || !r.ProtoAtLeast(1, 1) || cachedStatus(hdr) != http.StatusOK {
+		return
+	}
+	var hints []string
+	for _, v := range hdr.Values("Link") {
+		for _, link := range splitLinks(v) {
+			if len(preloadLinks([]string{link})) != 0 {
+				hints = append(hints, link)
+			}
+		}
+	}
+	if len(hints) == 0 {
+		return
+	}
+	wh := w.Header()
+	for _, link := range hints {
+		wh.Add("Link", link)
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+	wh.Del("Link")
+	s.rspEarlyHints.Add(1)
+}
+
+// preloadLinks returns the targets of the links with rel=preload in the given
+// Link header values (RFC 8288), in order.
+func preloadLinks(vals []string) []string {
+	var out []string
+	for _, v := range vals {
+		for _, link := range splitLinks(v) {
+			target, params, ok := strings.Cut(link, ">")
+			if !ok || !strings.HasPrefix(target, "<") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				name, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if !strings.EqualFold(strings.TrimSpace(name), "rel") {
+					continue
+				}
+				rels := strings.Fields(strings.ToLower(strings.Trim(strings.TrimSpace(val), `"`)))
+				for _, rel := range rels {
+					if rel == "preload" {
+						out = append(out, strings.TrimPrefix(target, "<"))
+						break
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// splitLinks splits a Link header value into its comma-separated links,
+// ignoring commas within the <target> of a link or in quoted parameters.
+func splitLinks(v string) []string {
+	var out []string
+	var inTarget, inQuote bool
+	start := 0
+	for i, c := range v {
+		switch {
+		case c == '"' && !inTarget:
+			inQuote = !inQuote
+		case c == '<' && !inQuote:
+			inTarget = true
+		case c == '>' && !inQuote:
+			inTarget = false
+		case c == ',' && !inTarget && !inQuote:
+			if link := strings.TrimSpace(v[start:i]); link != "" {
+				out = append(out, link)
+			}
+			start = i + 1
+		}
+	}
+	if link := strings.TrimSpace(v[start:]); link != "" {
+		out = append(out, link)
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// existsHeaderBytes is the number of bytes read from the start of an object in
+// S3 to find its header, when checking whether it exists. A header that does
+// not end within this range is read from the whole object instead.
+const existsHeaderBytes = 16 << 10
+
+// Exists reports whether an object with the given cache key is present in any
+// tier of the cache, and whether any copy of it is fresh. The tiers are
+// checked in order, and only object headers are read: Bodies are not loaded
+// from the local cache or from S3, and nothing is moved between tiers,
+// refreshed, or removed, even if it has expired. Consulting the memory cache
+// does not count as a use of its entry for the purpose of eviction.
+//
+// An object that has outlived its retention, or whose format version is not
+// supported, is reported as not present. An object with the no-cache
+// directive is never reported fresh, since it must be revalidated first, nor
+// is an object whose header is truncated, since its freshness is unknown. If a
+// tier could not be checked and no fresh copy was found elsewhere, Exists
+// reports the first such error.
+func (s *Server) Exists(ctx context.Context, hash string) (present, fresh bool, err error) {
+	s.init()
+	now := time.Now()
+	check := func(hdr http.Header, cerr error) bool {
+		if errors.Is(cerr, io.EOF) {
+			present = true // truncated header
+			return false
+		} else if cerr != nil {
+			if !errors.Is(cerr, fs.ErrNotExist) && gcerrors.Code(cerr) != gcerrors.NotFound && err == nil {
+				err = cerr
+			}
+			return false
+		} else if isExpired(hdr, now) {
+			return false
+		}
+		present = true
+		fresh = isFresh(hdr, now) && !mustRevalidate(hdr)
+		return fresh
+	}
+
+	if e, ok := s.memPeek(hash); ok && now.Before(e.removeAt) && check(e.header, nil) {
+		return true, true, nil
+	}
+	if s.diskAvailable() && check(s.readLocalHeader(hash)) {
+		return true, true, nil
+	}
+	if check(s.readS3Header(ctx, hash)) {
+		return true, true, nil
+	}
+	if present {
+		err = nil
+	}
+	return present, fresh, err
+}
+
+// readLocalHeader reads the header of the object for hash from the local
+// cache, without reading its body.
+func (s *Server) readLocalHeader(hash string) (http.Header, error) {
+	f, err := os.Open(s.makePath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hdr, _, err := readCacheHeader(bufio.NewReader(f))
+	return hdr, err
+}
+
+// readS3Header reads the header of the object for hash from S3, by reading
+// only the start of the object. As for openS3, the ReplicaBuckets are tried
+// if the primary bucket fails.
+func (s *Server) readS3Header(ctx context.Context, hash string) (http.Header, error) {
+	hdr, err := s.readBucketHeader(ctx, s.bucket(hash), hash)
+	for _, b := range s.ReplicaBuckets {
+		if err == nil || gcerrors.Code(err) == gcerrors.NotFound || ctx.Err() != nil {
+			break
+		}
+		hdr, err = s.readBucketHeader(ctx, b, hash)
+	}
+	return hdr, err
+}
+
+// readBucketHeader reads the header of the object for hash from b, by reading
+// only the start of the object, or as much of it as the header spans.
+func (s *Server) readBucketHeader(ctx context.Context, b *blob.Bucket, hash string) (http.Header, error) {
+	key := s.makeKey(hash)
+	rd, err := b.NewRangeReader(ctx, key, 0, existsHeaderBytes, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	hdr, _, err := readCacheHeader(bufio.NewReader(rd))
+	if errors.Is(err, io.EOF) && rd.Size() > existsHeaderBytes {
+		// The header continues past the range; read it from the whole object.
+		// Only the header is consumed before the reader is closed.
+		full, err := b.NewReader(ctx, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer full.Close()
+		hdr, _, err = readCacheHeader(bufio.NewReader(full))
+		return hdr, err
+	}
+	return hdr, err
+}
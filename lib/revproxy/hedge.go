@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultHedgeLimit is the default limit on hedged requests in flight.
+const defaultHedgeLimit = 8
+
+// hedgeTransport is a [http.RoundTripper] that hedges slow requests: If the
+// origin does not respond to a request within the hedge delay, a second copy
+// of the request is sent, and whichever responds first is used. The other is
+// canceled.
+type hedgeTransport struct {
+	s    *Server
+	base http.RoundTripper
+}
+
+// hedgeResult is the outcome of one attempt at a hedged request.
+type hedgeResult struct {
+	i   int // index of the attempt
+	rsp *http.Response
+	err error
+}
+
+// originTransport returns the transport to use for requests to the origin,
+// or nil to use the default.
+func (s *Server) originTransport() http.RoundTripper {
+	var rt http.RoundTripper
+	if s.HedgeDelay > 0 {
+		rt = &hedgeTransport{s: s, base: http.DefaultTransport}
+	}
+	if s.FollowRedirects > 0 {
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		rt = &redirectTransport{s: s, base: rt, hops: s.FollowRedirects}
+	}
+	return rt
+}
+
+// canHedge reports whether req may be sent more than once.
+func canHedge(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// tryHedge reports whether another hedged request may be sent now. If so, the
+// caller must call releaseHedge when the request is finished.
+func (s *Server) tryHedge() bool {
+	limit := s.HedgeLimit
+	if limit <= 0 {
+		limit = defaultHedgeLimit
+	}
+	if s.hedges.Add(1) > int64(limit) {
+		s.hedges.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) releaseHedge() { s.hedges.Add(-1) }
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !canHedge(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func(hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			if hedge {
+				defer t.s.releaseHedge()
+			}
+			rsp, err := t.base.RoundTrip(req.Clone(ctx))
+			results <- hedgeResult{i: i, rsp: rsp, err: err}
+		}()
+	}
+	launch(false)
+
+	timer := time.NewTimer(t.s.HedgeDelay)
+	defer timer.Stop()
+	for pending := 1; ; {
+		select {
+		case <-timer.C:
+			// If too many hedged requests are already in flight, the origin is
+			// probably slow across the board, and we should not add to its load.
+			if t.s.tryHedge() {
+				t.s.reqHedged.Add(1)
+				t.s.vlogf("rp hedge %q", req.URL)
+				launch(true)
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				cancels[res.i]()
+				continue // wait for the other attempt
+			}
+
+			// This attempt wins: Cancel the others, and clean up after them.
+			for j, cancel := range cancels {
+				if j != res.i {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if r := <-results; r.rsp != nil {
+						r.rsp.Body.Close()
+					}
+				}()
+			}
+
+			if res.err != nil {
+				cancels[res.i]()
+				return nil, res.err
+			}
+			if res.i > 0 {
+				t.s.reqHedgeWon.Add(1)
+			}
+			res.rsp.Body = cancelBody{ReadCloser: res.rsp.Body, cancel: cancels[res.i]}
+			return res.rsp, nil
+		}
+	}
+}
+
+// cancelBody is a response body that cancels the context of its request when
+// it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelBody) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
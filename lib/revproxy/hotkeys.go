@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+)
+
+// defaultHotKeyMaxStale is the default grace period for serving stale memory
+// entries for hot keys.
+const defaultHotKeyMaxStale = 30 * time.Second
+
+// keyRates tracks request rates per key, to identify hot keys.
+//
+// Requests are counted in windows of one second. At the end of each window,
+// the keys whose counts reached the threshold become the hot set for the next
+// window. A key also becomes hot as soon as its count in the current window
+// reaches the threshold.
+type keyRates struct {
+	mu         sync.Mutex
+	window     time.Time      // start of the current window
+	counts     map[string]int // request counts in the current window
+	hot        mapset.Set[string]
+	refreshing mapset.Set[string] // keys with a background refresh in progress
+}
+
+// recordKey records a request for hash at time now, and reports whether hash
+// is currently hot. If hot key protection is disabled, it does nothing and
+// reports false.
+func (s *Server) recordKey(hash string, now time.Time) bool {
+	if s.HotKeyThreshold <= 0 {
+		return false
+	}
+	k := &s.hotKeys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if elapsed := now.Sub(k.window); elapsed >= time.Second {
+		k.hot.Clear()
+		for key, n := range k.counts {
+			if float64(n)/elapsed.Seconds() >= s.HotKeyThreshold {
+				k.hot.Add(key)
+			}
+		}
+		k.window = now
+		k.counts = make(map[string]int)
+	}
+	k.counts[hash]++
+	if float64(k.counts[hash]) >= s.HotKeyThreshold {
+		k.hot.Add(hash)
+	}
+	return k.hot.Has(hash)
+}
+
+// HotKeys returns the cache keys that are currently considered hot, in
+// lexicographic order.
+func (s *Server) HotKeys() []string {
+	k := &s.hotKeys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	out := k.hot.Slice()
+	slices.Sort(out)
+	return out
+}
+
+func (s *Server) hotKeyMaxStale() time.Duration {
+	if s.HotKeyThreshold <= 0 {
+		return 0
+	} else if s.HotKeyMaxStale > 0 {
+		return s.HotKeyMaxStale
+	}
+	return defaultHotKeyMaxStale
+}
+
+// refreshEarly starts a background refresh of the fresh cached object for r,
+// with key hash and header hdr, if the XFetch algorithm selects this request to
+// do so as of now. See EarlyExpirationBeta.
+//
+// With delta the time it took to fetch the object, a request refreshes the
+// object early if now - delta*beta*ln(rand()) is past its expiry. The closer
+// the object is to expiry, and the longer it took to fetch, the more likely
+// this is.
+func (s *Server) refreshEarly(r *http.Request, hash string, hdr http.Header, now time.Time) {
+	if s.EarlyExpirationBeta <= 0 {
+		return
+	}
+	delta := fetchTime(hdr)
+	if delta == 0 {
+		return // we don't know how long it takes to fetch
+	}
+	rem, ok := freshnessRemaining(hdr, now)
+	if !ok || rem <= 0 {
+		return
+	}
+	gap := -float64(delta) * s.EarlyExpirationBeta * math.Log(1-rand.Float64())
+	if time.Duration(gap) >= rem {
+		s.reqEarlyRefresh.Add(1)
+		traceOf(r).addf("refresh", time.Time{}, "early, %v before expiry", rem)
+		s.refreshAsync(r, hash)
+	}
+}
+
+// refreshAsync starts a fetch of r from the origin in the background, to
+// refresh the cached object for hash. If a refresh for hash is already in
+// progress, it does nothing.
+//
+// Refreshes do not wait for other background tasks, so that a hot key is
+// refreshed promptly.
+func (s *Server) refreshAsync(r *http.Request, hash string) {
+	if ok, _ := s.originAvailable(time.Now()); !ok {
+		return // leave the origin alone for now
+	}
+	k := &s.hotKeys
+	k.mu.Lock()
+	if k.refreshing.Has(hash) {
+		k.mu.Unlock()
+		return
+	}
+	k.refreshing.Add(hash)
+	k.mu.Unlock()
+
+	req := r.Clone(context.Background())
+	if r.GetBody != nil {
+		req.Body, _ = r.GetBody() // replay a body that is part of the key
+	}
+	s.reqRefreshStart.Add(1)
+	s.reqRefreshActive.Add(1)
+	go func() {
+		defer func() {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			k.refreshing.Remove(hash)
+		}()
+		start := time.Now()
+		w := &warmResponse{header: make(http.Header)}
+		s.forward(w, req, hash, true, nil, start)
+		s.reqRefreshActive.Add(-1)
+		s.reqRefreshMillis.Add(time.Since(start).Milliseconds())
+		if refreshSucceeded(w) {
+			s.reqRefreshOK.Add(1)
+		} else {
+			s.reqRefreshFail.Add(1)
+		}
+		s.vlogf("rp refresh H:%s done: status %d (%v elapsed)", hash, w.code, time.Since(start))
+	}()
+}
+
+// refreshSucceeded reports whether w, the response to a background refresh,
+// shows that the origin responded. A server error, or a stale copy served in
+// place of one, means the cached object was not refreshed.
+func refreshSucceeded(w *warmResponse) bool {
+	if w.code == 0 || w.code >= http.StatusInternalServerError {
+		return false
+	}
+	return !slices.Contains(w.header.Values("Warning"), warnRevalidationFailed)
+}
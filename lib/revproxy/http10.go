@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// defaultLegacyBufferBytes is the default limit on the size of a response
+// buffered to give it a Content-Length for an HTTP/1.0 client.
+const defaultLegacyBufferBytes = 16 << 20
+
+// needsLength reports whether the response rsp to r, from an HTTP/1.0
+// client, must be given a length before it is sent: It has a body, and no
+// declared length.
+func needsLength(r *http.Request, rsp *http.Response) bool {
+	if rsp.ContentLength >= 0 || r.Method == http.MethodHead {
+		return false
+	}
+	switch rsp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	return rsp.StatusCode >= http.StatusOK
+}
+
+// bufferLength reads the body of rsp into memory and sets its Content-Length,
+// if the body is no longer than LegacyBufferBytes. If the body is longer, rsp
+// is left without a length, and is delimited by closing the connection.
+func (s *Server) bufferLength(rsp *http.Response) error {
+	limit := s.LegacyBufferBytes
+	if limit == 0 {
+		limit = defaultLegacyBufferBytes
+	} else if limit < 0 {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, limit+1))
+	if err != nil {
+		rsp.Body.Close()
+		return err
+	}
+	if int64(len(data)) > limit {
+		// Too large to buffer: Send what we read, followed by the rest.
+		rsp.Body = copyReader{Reader: io.MultiReader(bytes.NewReader(data), rsp.Body), Closer: rsp.Body}
+		return nil
+	}
+	rsp.Body.Close()
+	rsp.Body = io.NopCloser(bytes.NewReader(data))
+	rsp.ContentLength = int64(len(data))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/scheddle"
+)
+
+// newIdleTracker returns a record of the last use of a memory cache entry
+// stored at now, as a Unix time in nanoseconds, if MemoryIdleTimeout is set,
+// and otherwise nil. The record is shared by the copies of the entry, and
+// identifies the entry to its idle check.
+func (s *Server) newIdleTracker(now time.Time) *atomic.Int64 {
+	if s.MemoryIdleTimeout <= 0 {
+		return nil
+	}
+	used := new(atomic.Int64)
+	used.Store(now.UnixNano())
+	return used
+}
+
+// touch records a use of e as of now.
+func (e memCacheEntry) touch(now time.Time) {
+	if e.used != nil {
+		e.used.Store(now.UnixNano())
+	}
+}
+
+// idleSet records the last-use record of the current memory cache entry for
+// each key with one, so that an idle check can identify the entry without
+// looking it up in the memory cache, which would count as a use of it.
+type idleSet struct {
+	mu   sync.Mutex
+	used map[string]*atomic.Int64
+}
+
+// set records used for hash, or discards the record if used == nil.
+func (w *idleSet) set(hash string, used *atomic.Int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if used == nil {
+		delete(w.used, hash)
+		return
+	} else if w.used == nil {
+		w.used = make(map[string]*atomic.Int64)
+	}
+	w.used[hash] = used
+}
+
+func (w *idleSet) get(hash string) *atomic.Int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.used[hash]
+}
+
+// forget discards the record for hash, if it is used.
+func (w *idleSet) forget(hash string, used *atomic.Int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.used[hash] == used {
+		delete(w.used, hash)
+	}
+}
+
+// scheduleIdle arranges for the memory cache entry for hash, whose last use
+// is recorded by used, to be checked after d, as checkIdle. If the entry is
+// still in use, it is checked again when it next could be idle. Like
+// expirations, the checks count against MaxPendingExpirations, and past that
+// limit the entry is left for the next sweep instead.
+func (s *Server) scheduleIdle(hash string, used *atomic.Int64, d time.Duration) {
+	if used == nil {
+		return
+	} else if s.MaxPendingExpirations > 0 && s.expirePending.Value() >= int64(s.MaxPendingExpirations) {
+		s.idleSweep.add(hash)
+		return
+	}
+	s.expirePending.Add(1)
+	s.expire.After(d, scheddle.Run(func() {
+		s.expirePending.Add(-1)
+		if wait, done := s.checkIdle(hash, used); !done {
+			s.scheduleIdle(hash, used, wait)
+		}
+	}))
+}
+
+// checkIdle removes the memory cache entry for hash, whose last use is
+// recorded by used, if it has not been used within MemoryIdleTimeout. It
+// reports whether the entry no longer needs to be checked, and otherwise how
+// long until it could next be idle. Pinned entries are not removed, nor are
+// entries replaced since used was created. The checks of a pinned entry stop
+// until it is unpinned, but its record is kept so that Unpin can resume them.
+// The entry is not looked up, so the check does not count as a use of it.
+func (s *Server) checkIdle(hash string, used *atomic.Int64) (time.Duration, bool) {
+	if used == nil || s.idlers.get(hash) != used {
+		s.idlers.forget(hash, used)
+		return 0, true // removed or replaced
+	} else if !s.mcache.Has(hash) {
+		if !s.pins.holds(hash, used) {
+			s.idlers.forget(hash, used) // removed
+		}
+		return 0, true
+	}
+	idle := time.Since(time.Unix(0, used.Load()))
+	if idle < s.MemoryIdleTimeout {
+		return s.MemoryIdleTimeout - idle, false
+	}
+	s.lruRemove(hash)
+	s.idlers.forget(hash, used)
+	s.memIdleEvict.Add(1)
+	s.vlogf("rp - H:%s idle for %v, removed from memory", hash, idle.Round(time.Second))
+	return 0, true
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// defaultKeyBodyMaxBytes is the default limit on the size of a request body
+// included in the cache key.
+const defaultKeyBodyMaxBytes = 64 << 10
+
+type keyBodyKey struct{}
+
+// bufferKeyBody reports whether r is a POST request whose body should be
+// included in its cache key, per KeyBodyContentTypes. If so, it reads the
+// body and returns a copy of r that replays it to the origin, and records its
+// digest for hashRequest. Otherwise, r is returned unmodified.
+//
+// If the body exceeds KeyBodyMaxBytes, the request is not cacheable; the body
+// is passed on to the origin unchanged.
+func (s *Server) bufferKeyBody(r *http.Request) *http.Request {
+	if len(s.KeyBodyContentTypes) == 0 || r.Method != http.MethodPost || r.Body == nil {
+		return r
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !slices.ContainsFunc(s.KeyBodyContentTypes, func(ct string) bool {
+		return strings.EqualFold(ct, mt)
+	}) {
+		return r
+	}
+	limit := s.KeyBodyMaxBytes
+	if limit <= 0 {
+		limit = defaultKeyBodyMaxBytes
+	}
+	if r.ContentLength > limit {
+		return r
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		r.Body = copyReader{Reader: io.MultiReader(bytes.NewReader(data), r.Body), Closer: r.Body}
+		return r
+	}
+	r.Body.Close()
+
+	key := fmt.Sprintf("%s %x", mt, sha256.Sum256(data))
+	r = r.WithContext(context.WithValue(r.Context(), keyBodyKey{}, key))
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.ContentLength = int64(len(data))
+	return r
+}
+
+// keyBody returns the key recorded for the body of r by bufferKeyBody, or ""
+// if the body of r is not part of its cache key.
+func keyBody(r *http.Request) string {
+	key, _ := r.Context().Value(keyBodyKey{}).(string)
+	return key
+}
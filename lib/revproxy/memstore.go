@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"cmp"
+	"fmt"
+	"sync"
+
+	"github.com/creachadair/mds/cache"
+	"github.com/creachadair/mds/heapq"
+)
+
+// lruStore is an implementation of the [cache.Store] interface for memory
+// cache entries, that evicts the least-recently accessed entries first.
+//
+// This is the policy of [cache.LRU], whose store is not accessible outside
+// the cache, so it cannot be wrapped by a [peekStore].
+type lruStore struct {
+	present map[string]int // :: key → offset in access
+	access  *heapq.Queue[lruEntry]
+	clock   int64
+}
+
+type lruEntry struct {
+	lastAccess int64
+	key        string
+	value      memCacheEntry
+}
+
+func newLRUStore() *lruStore {
+	c := &lruStore{present: make(map[string]int)}
+	c.access = heapq.New(func(a, b lruEntry) int {
+		return cmp.Compare(a.lastAccess, b.lastAccess)
+	})
+	c.access.Update(func(e lruEntry, pos int) { c.present[e.key] = pos })
+	return c
+}
+
+// Check implements part of the [cache.Store] interface.
+func (c *lruStore) Check(key string) (memCacheEntry, bool) {
+	pos, ok := c.present[key]
+	if !ok {
+		return memCacheEntry{}, false
+	}
+	e, ok := c.access.Peek(pos)
+	return e.value, ok
+}
+
+// Access implements part of the [cache.Store] interface.
+func (c *lruStore) Access(key string) (memCacheEntry, bool) {
+	pos, ok := c.present[key]
+	if !ok {
+		return memCacheEntry{}, false
+	}
+	c.clock++
+	e, _ := c.access.Remove(pos) // cannot fail
+	e.lastAccess = c.clock
+	c.access.Add(e)
+	return e.value, true
+}
+
+// Store implements part of the [cache.Store] interface.
+func (c *lruStore) Store(key string, val memCacheEntry) {
+	if _, ok := c.present[key]; ok {
+		panic(fmt.Sprintf("lru store: unexpected key %v", key))
+	}
+	c.clock++
+	c.present[key] = c.access.Add(lruEntry{
+		lastAccess: c.clock,
+		key:        key,
+		value:      val,
+	})
+}
+
+// Remove implements part of the [cache.Store] interface.
+func (c *lruStore) Remove(key string) {
+	if pos, ok := c.present[key]; ok {
+		c.access.Remove(pos)
+		delete(c.present, key)
+	}
+}
+
+// Evict implements part of the [cache.Store] interface.
+func (c *lruStore) Evict() (string, memCacheEntry) {
+	e, ok := c.access.Pop()
+	if !ok {
+		panic("lru evict: no entries left")
+	}
+	delete(c.present, e.key)
+	return e.key, e.value
+}
+
+// peekStore wraps a [cache.Store] so that entries can be looked up without
+// recording an access, which a [cache.Cache] does not support. The cache
+// serializes its own calls to the store, but a peek comes from outside it, so
+// the wrapper needs a lock of its own.
+type peekStore struct {
+	mu    sync.Mutex
+	store cache.Store[string, memCacheEntry]
+}
+
+// peek reports whether key is present and, if so, returns its entry without
+// recording an access.
+func (p *peekStore) peek(key string) (memCacheEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.store.Check(key)
+}
+
+// Check implements part of the [cache.Store] interface.
+func (p *peekStore) Check(key string) (memCacheEntry, bool) { return p.peek(key) }
+
+// Access implements part of the [cache.Store] interface.
+func (p *peekStore) Access(key string) (memCacheEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.store.Access(key)
+}
+
+// Store implements part of the [cache.Store] interface.
+func (p *peekStore) Store(key string, val memCacheEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.store.Store(key, val)
+}
+
+// Remove implements part of the [cache.Store] interface.
+func (p *peekStore) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.store.Remove(key)
+}
+
+// Evict implements part of the [cache.Store] interface.
+func (p *peekStore) Evict() (string, memCacheEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.store.Evict()
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+	"github.com/creachadair/scheddle"
+)
+
+// defaultSweepInterval is the default interval between sweeps of the memory
+// cache when MaxPendingExpirations is set.
+const defaultSweepInterval = time.Minute
+
+// sweepSet records the keys of memory cache entries whose expiration was not
+// scheduled individually, and must be found by a periodic sweep.
+type sweepSet struct {
+	mu   sync.Mutex
+	keys mapset.Set[string]
+}
+
+func (w *sweepSet) add(hash string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.keys.Add(hash)
+}
+
+// sweep calls f for each recorded key, and forgets those for which f reports
+// true.
+func (w *sweepSet) sweep(f func(hash string) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for hash := range w.keys {
+		if f(hash) {
+			w.keys.Remove(hash)
+		}
+	}
+}
+
+// scheduleExpire arranges for the memory cache entry for hash to be removed
+// after lifetime, if it has not been replaced by then. If the number of
+// pending expirations has reached MaxPendingExpirations, the entry is left
+// for the next sweep instead of being scheduled.
+func (s *Server) scheduleExpire(hash string, lifetime time.Duration, removeAt time.Time) {
+	if s.MaxPendingExpirations > 0 && s.expirePending.Value() >= int64(s.MaxPendingExpirations) {
+		s.sweepKeys.add(hash)
+		return
+	}
+	s.expirePending.Add(1)
+	s.expire.After(lifetime, scheddle.Run(func() {
+		defer s.expirePending.Add(-1)
+
+		// Don't remove the entry if it was replaced after we were scheduled.
+		if e, ok := s.memGet(hash); ok && !e.removeAt.After(removeAt) {
+			s.memRemove(hash)
+		}
+	}))
+}
+
+// scheduleStub arranges for the body of the memory cache entry for hash to be
+// dropped after d, leaving only its header, if it has not been replaced by
+// then. As for scheduleExpire, if the number of pending expirations has
+// reached MaxPendingExpirations, the entry is left for the next sweep.
+func (s *Server) scheduleStub(hash string, d time.Duration, removeAt time.Time) {
+	if s.MaxPendingExpirations > 0 && s.expirePending.Value() >= int64(s.MaxPendingExpirations) {
+		s.sweepKeys.add(hash)
+		return
+	}
+	s.expirePending.Add(1)
+	s.expire.After(d, scheddle.Run(func() {
+		defer s.expirePending.Add(-1)
+		if e, ok := s.memPeek(hash); ok && e.removeAt.Equal(removeAt) {
+			s.stubMemory(hash, e)
+		}
+	}))
+}
+
+// scheduleSweep schedules the next sweep of the memory cache, if expirations
+// are capped.
+func (s *Server) scheduleSweep() {
+	if s.MaxPendingExpirations <= 0 {
+		return
+	}
+	d := s.MemorySweepInterval
+	if d <= 0 {
+		d = defaultSweepInterval
+	}
+	s.expire.After(d, scheddle.Run(func() {
+		defer s.scheduleSweep()
+		s.sweepMemory()
+	}))
+}
+
+// sweepMemory removes expired entries recorded for sweeping from the memory
+// cache, and idle entries recorded for idle checks (see checkIdle). Entries
+// retained only for their headers have their bodies dropped. Keys whose
+// entries are no longer present are forgotten.
+func (s *Server) sweepMemory() {
+	now := time.Now()
+	s.sweepKeys.sweep(func(hash string) bool {
+		e, ok := s.memGet(hash)
+		if !ok {
+			return true
+		} else if now.Before(e.removeAt) {
+			if e.dueStub(now) {
+				s.stubMemory(hash, e)
+			}
+			return false
+		}
+		s.memRemove(hash)
+		s.memSweepRemove.Add(1)
+		return true
+	})
+	s.idleSweep.sweep(func(hash string) bool {
+		_, done := s.checkIdle(hash, s.idlers.get(hash))
+		return done
+	})
+}
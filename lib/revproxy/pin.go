@@ -0,0 +1,186 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/creachadair/mds/mapset"
+)
+
+// defaultMaxPinnedBytes is the default limit on the total size of the bodies
+// of pinned memory cache entries.
+const defaultMaxPinnedBytes = 1 << 20
+
+// pinSet records the pinned keys, and holds the memory cache entries for them
+// outside the LRU, so that they are not evicted to make room.
+type pinSet struct {
+	mu    sync.Mutex
+	keys  mapset.Set[string]
+	held  map[string]memCacheEntry
+	bytes int64 // total size of held entries
+}
+
+// Pin marks the object with the given cache key as pinned. The memory cache
+// entry for a pinned object is exempt from eviction for capacity or memory
+// pressure, though it is still removed when its lifetime ends, and replaced
+// when the object is fetched again. Pins last until removed by [Server.Unpin].
+//
+// At most MaxPinnedBytes of pinned entries are held this way. An entry that
+// does not fit within the limit is stored in the memory cache as usual, and
+// remains subject to eviction until there is room.
+//
+// The local cache does not evict objects for capacity, so pinning does not
+// change how it treats them.
+func (s *Server) Pin(hash string) {
+	s.init()
+	p := &s.pins
+	p.mu.Lock()
+	p.keys.Add(hash)
+	p.mu.Unlock()
+
+	if e, ok := s.mcache.Get(hash); ok && s.holdPinned(hash, e) {
+		s.lruRemove(hash)
+	}
+}
+
+// Unpin removes the pin for the object with the given cache key, if any. Its
+// memory cache entry, if it has one, becomes subject to eviction again, and if
+// MemoryIdleTimeout is set, it is checked for idleness again after that long.
+func (s *Server) Unpin(hash string) {
+	s.init()
+	p := &s.pins
+	p.mu.Lock()
+	e, ok := p.held[hash]
+	p.keys.Remove(hash)
+	p.dropLocked(hash)
+	p.mu.Unlock()
+
+	if ok {
+		s.lruPut(hash, e)
+		if e.used != nil && s.idlers.get(hash) == e.used {
+			s.scheduleIdle(hash, e.used, s.MemoryIdleTimeout)
+		}
+	}
+}
+
+// PinnedKeys returns the cache keys that are currently pinned, in
+// lexicographic order.
+func (s *Server) PinnedKeys() []string {
+	p := &s.pins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := p.keys.Slice()
+	slices.Sort(out)
+	return out
+}
+
+// holdPinned stores e as the entry for hash outside the LRU, and reports
+// whether it did so. It reports false if hash is not pinned, or if e does not
+// fit within MaxPinnedBytes.
+func (s *Server) holdPinned(hash string, e memCacheEntry) bool {
+	limit := s.MaxPinnedBytes
+	if limit <= 0 {
+		limit = defaultMaxPinnedBytes
+	}
+	p := &s.pins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.keys.Has(hash) {
+		return false
+	}
+	old := p.held[hash]
+	if p.bytes-entrySize(old)+entrySize(e) > limit {
+		s.logf("pin %q: %d bytes exceeds pinned limit %d", hash, entrySize(e), limit)
+		p.dropLocked(hash)
+		return false
+	}
+	if p.held == nil {
+		p.held = make(map[string]memCacheEntry)
+	}
+	p.bytes += entrySize(e) - entrySize(old)
+	p.held[hash] = e
+	return true
+}
+
+// dropLocked discards the held entry for hash, if any. The caller must hold
+// p.mu.
+func (p *pinSet) dropLocked(hash string) {
+	if e, ok := p.held[hash]; ok {
+		p.bytes -= entrySize(e)
+		delete(p.held, hash)
+	}
+}
+
+// holds reports whether p holds the entry for hash whose last use is recorded
+// by used.
+func (p *pinSet) holds(hash string, used *atomic.Int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.held[hash]
+	return ok && e.used == used
+}
+
+// pinnedBytes reports the total size of the pinned entries held.
+func (s *Server) pinnedBytes() int64 {
+	p := &s.pins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bytes
+}
+
+// memGet returns the memory cache entry for hash, whether pinned or not.
+func (s *Server) memGet(hash string) (memCacheEntry, bool) {
+	p := &s.pins
+	p.mu.Lock()
+	e, ok := p.held[hash]
+	p.mu.Unlock()
+	if ok {
+		return e, true
+	}
+	return s.mcache.Get(hash)
+}
+
+// memPeek is as memGet, except that it does not count as a use of the entry
+// for eviction.
+func (s *Server) memPeek(hash string) (memCacheEntry, bool) {
+	p := &s.pins
+	p.mu.Lock()
+	e, ok := p.held[hash]
+	p.mu.Unlock()
+	if ok {
+		return e, true
+	}
+	return s.mstore.peek(hash)
+}
+
+// memHas reports whether there is a memory cache entry for hash, other than a
+// stub retaining only its header. This does not count as a use of the entry
+// for eviction.
+func (s *Server) memHas(hash string) bool {
+	e, ok := s.memPeek(hash)
+	return ok && !e.stub
+}
+
+// memPut stores e as the memory cache entry for hash, outside the LRU if hash
+// is pinned and e fits.
+func (s *Server) memPut(hash string, e memCacheEntry) {
+	if s.holdPinned(hash, e) {
+		s.lruRemove(hash)
+		return
+	}
+	s.lruPut(hash, e)
+}
+
+// memRemove removes the memory cache entry for hash, whether pinned or not.
+// The pin itself, if any, remains.
+func (s *Server) memRemove(hash string) {
+	p := &s.pins
+	p.mu.Lock()
+	p.dropLocked(hash)
+	p.mu.Unlock()
+	s.lruRemove(hash)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+)
+
+// maxSequentialPrefetch is the maximum number of sequential prefetches in
+// flight at once.
+const maxSequentialPrefetch = 4
+
+// prefetchSet tracks the keys being prefetched by SequentialPrefetch.
+type prefetchSet struct {
+	mu     sync.Mutex
+	active mapset.Set[string]
+}
+
+// claim reports whether hash may be prefetched now. If so, the caller must
+// call release when the prefetch is finished.
+func (p *prefetchSet) claim(hash string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active.Has(hash) || p.active.Len() >= maxSequentialPrefetch {
+		return false
+	}
+	p.active.Add(hash)
+	return true
+}
+
+func (p *prefetchSet) release(hash string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active.Remove(hash)
+}
+
+// prefetchNext asks SequentialPrefetch for the URL likely to be requested
+// after r, and if the object for it is in S3 but not in the local cache,
+// copies it to the local cache in the background. It never contacts the
+// origin.
+func (s *Server) prefetchNext(r *http.Request) {
+	next, ok := s.SequentialPrefetch(r.URL.String())
+	if !ok {
+		return
+	}
+	u, err := r.URL.Parse(next)
+	if err != nil {
+		s.logf("prefetch %q: invalid next URL: %v", next, err)
+		return
+	}
+	req := r.Clone(context.Background())
+	req.URL, req.RequestURI = u, u.String()
+	if u.Host != "" {
+		req.Host = u.Host
+	}
+	if !hostMatchesTarget(req.Host, s.Targets) {
+		return
+	}
+	hash := s.hashRequest(req)
+	if !s.diskAvailable() {
+		return // nowhere to put it
+	} else if s.memHas(hash) || fileExists(s.makePath(hash)) {
+		return // already warm
+	} else if !s.prefetches.claim(hash) {
+		return // in progress, or too many
+	}
+	go func() {
+		defer s.prefetches.release(hash)
+		data, hdr, err := s.cacheLoadS3(req.Context(), hash)
+		if err != nil || !isFresh(hdr, time.Now()) {
+			return // not in S3, or not worth promoting
+		}
+		if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
+			s.logf("prefetch %q to local: %v", hash, err)
+			return
+		}
+		s.reqSeqPrefetch.Add(1)
+		s.vlogf("rp prefetch H:%s for %q B:%d", hash, u, len(data))
+	}()
+}
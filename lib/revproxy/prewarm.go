@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/creachadair/taskgroup"
+)
+
+// Prewarm opens PrewarmConnections connections to each of the Targets, and
+// leaves them idle in the pool of the origin transport, so that the first
+// requests forwarded to the origin do not pay for connection setup and TLS
+// handshakes. Call Prewarm before serving requests; it does nothing if
+// PrewarmConnections is not positive.
+//
+// Each connection is opened by a HEAD request for the root of the target,
+// routed as by [Server.UpstreamURL]. The responses are discarded. Failures
+// are logged, but do not prevent the server from starting; the origin may
+// simply be unreachable for now.
+//
+// The default transport keeps at most [http.DefaultMaxIdleConnsPerHost] idle
+// connections to each host, so connections beyond that are closed once the
+// request that opened them completes.
+func (s *Server) Prewarm(ctx context.Context) {
+	if s.PrewarmConnections <= 0 {
+		return
+	}
+	s.init()
+	g := taskgroup.New(nil)
+	for _, host := range s.Targets {
+		for range s.PrewarmConnections {
+			g.Go(func() error {
+				if err := s.prewarmOne(ctx, host); err != nil {
+					s.logf("prewarm %q: %v", host, err)
+				}
+				return nil
+			})
+		}
+	}
+	g.Wait()
+}
+
+// prewarmOne issues a single HEAD request to the origin for host, so that the
+// connection it uses remains in the pool.
+func (s *Server) prewarmOne(ctx context.Context, host string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "/", nil)
+	if err != nil {
+		return err
+	}
+	req.Host, req.RequestURI = host, "/"
+	u, err := s.upstreamURL(req)
+	if err != nil {
+		return err
+	}
+	out := req.Clone(ctx)
+	out.URL, out.Host, out.RequestURI = u, u.Host, ""
+	rsp, err := http.DefaultTransport.RoundTrip(out)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+	s.vlogf("prewarm %q: status %d", host, rsp.StatusCode)
+	return nil
+}
@@ -0,0 +1,322 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/creachadair/scheddle"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// purgeLimit limits the number of purges in progress at once, according to
+// MaxConcurrentPurges. The zero value is ready for use.
+type purgeLimit struct {
+	once sync.Once
+	sem  chan struct{} // nil if purges are not limited
+}
+
+// acquire waits until a purge may begin, with at most n in progress, or until
+// ctx ends. If n <= 0, purges are not limited. On success, the caller must
+// call release when its purge is done.
+func (p *purgeLimit) acquire(ctx context.Context, n int) (release func(), err error) {
+	p.once.Do(func() {
+		if n > 0 {
+			p.sem = make(chan struct{}, n)
+		}
+	})
+	if p.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.sem <- struct{}{}:
+		return func() { <-p.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// A purgeFlight is a purge of a single object, in progress or recently done.
+type purgeFlight struct {
+	done chan struct{} // closed when the purge is done
+	err  error         // the result of the purge, once done
+}
+
+// purgeGroup tracks purges in progress or done within the PurgeDedupWindow,
+// so that duplicate purges of the same object can share the result of one.
+type purgeGroup struct {
+	mu sync.Mutex
+	m  map[string]*purgeFlight
+}
+
+// Purge removes the object for the specified request hash, and any of its
+// PrecomputeVariants, from every cache tier: memory, the local cache, S3, and
+// the ReplicaBuckets. Objects already absent from a tier are not an error.
+//
+// At most MaxConcurrentPurges purges are in progress at once. Others wait
+// their turn, or until ctx ends. If PurgeDedupWindow is set, a purge of an
+// object that is already being purged, or was purged within the window,
+// waits for that purge and reports its result instead. A shared purge is not
+// tied to the context of any one caller: It runs to completion, within
+// purgeTimeout, even if the caller that began it gives up.
+func (s *Server) Purge(ctx context.Context, hash string) error {
+	s.init()
+	if s.PurgeDedupWindow <= 0 {
+		return s.purge(ctx, hash)
+	}
+	g := &s.purgeDups
+	g.mu.Lock()
+	f, ok := g.m[hash]
+	if ok {
+		s.purgeDeduped.Add(1)
+	} else {
+		if g.m == nil {
+			g.m = make(map[string]*purgeFlight)
+		}
+		f = &purgeFlight{done: make(chan struct{})}
+		g.m[hash] = f
+		go func() {
+			pctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), purgeTimeout)
+			defer cancel()
+			f.err = s.purge(pctx, hash)
+			close(f.done)
+			s.expire.After(s.PurgeDedupWindow, scheddle.Run(func() {
+				g.mu.Lock()
+				defer g.mu.Unlock()
+				if g.m[hash] == f {
+					delete(g.m, hash)
+				}
+			}))
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// purgeTimeout is the time allowed for a purge shared by deduplicated calls
+// to Purge, including any wait for its turn under MaxConcurrentPurges.
+const purgeTimeout = 5 * time.Minute
+
+// purge implements Purge, without deduplication.
+func (s *Server) purge(ctx context.Context, hash string) error {
+	s.purgeQueued.Add(1)
+	release, err := s.purges.acquire(ctx, s.MaxConcurrentPurges)
+	s.purgeQueued.Add(-1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	switch s.PurgeStoreOrdering {
+	case PurgeWaitsForStores:
+		if err := s.stores.wait(ctx, hash); err != nil {
+			return err
+		}
+	case PurgeCancelsStores:
+		s.stores.cancel(hash)
+	}
+
+	hashes := []string{hash}
+	for _, enc := range s.PrecomputeVariants {
+		hashes = append(hashes, variantHash(hash, enc))
+	}
+	var errs []error
+	for _, h := range hashes {
+		if err := s.removeObject(ctx, h); err != nil {
+			errs = append(errs, fmt.Errorf("purge %w", err))
+		}
+	}
+	s.purgeDone.Add(1)
+	s.vlogf("purged %q (%d errors)", hash, len(errs))
+	return errors.Join(errs...)
+}
+
+// removeObject removes the object for hash from memory, the local cache, S3,
+// and the ReplicaBuckets. Objects already absent from a tier are not an error.
+//
+// If there are S3Buckets, the object is removed from all of them, not only
+// from the one it is now assigned to, since a copy stored before the list of
+// buckets changed may remain in the bucket it was assigned to then.
+func (s *Server) removeObject(ctx context.Context, hash string) error {
+	var errs []error
+	s.memRemove(hash)
+	if s.diskAvailable() {
+		if err := os.Remove(s.makePath(hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.recordDisk(err)
+			errs = append(errs, fmt.Errorf("%q local: %w", hash, err))
+		}
+	}
+	buckets := s.S3Buckets
+	if len(buckets) == 0 {
+		buckets = []*blob.Bucket{s.Bucket}
+	}
+	buckets = slices.Concat(buckets, s.ReplicaBuckets)
+	for _, b := range buckets {
+		if err := b.Delete(ctx, s.makeKey(hash)); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			errs = append(errs, fmt.Errorf("%q S3: %w", hash, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PurgeStoreOrdering specifies how a purge of an object is ordered with
+// respect to stores of the same object in progress when it begins (see
+// [Server.PurgeStoreOrdering]).
+type PurgeStoreOrdering int
+
+const (
+	// PurgeUnordered does not order purges and stores (the default). A store
+	// in progress when the object is purged, such as the background write of
+	// a fetch to S3, may complete after the purge, so the object may be
+	// cached again.
+	PurgeUnordered PurgeStoreOrdering = iota
+
+	// PurgeWaitsForStores makes a purge wait until no fetches or stores of
+	// the object are in progress before removing it, so that everything they
+	// stored is removed. A purge may therefore take as long as the slowest
+	// fetch and upload of the object, and for an object fetched continually,
+	// it may wait until the fetches let up.
+	PurgeWaitsForStores
+
+	// PurgeCancelsStores makes fetches and stores of the object in progress
+	// when it is purged skip any tier writes they have not yet begun, so the
+	// purge does not wait, but the fetched data is discarded. A write already
+	// underway when the purge begins may still complete after it.
+	PurgeCancelsStores
+)
+
+// storeTracker tracks fetches and stores of objects in progress, to order
+// them with purges according to PurgeStoreOrdering. The zero value is ready
+// for use.
+type storeTracker struct {
+	mu   sync.Mutex
+	seq  uint64 // incremented by each purge
+	keys map[string]*keyStores
+}
+
+// keyStores records the stores in progress for a single object.
+type keyStores struct {
+	active int           // tokens outstanding
+	purged uint64        // seq of the last purge while stores were active
+	idle   chan struct{} // closed when active reaches 0
+}
+
+// A storeToken represents a fetch of an object and the stores that follow
+// from it. A nil *storeToken is valid, and is never cancelled.
+type storeToken struct {
+	t    *storeTracker
+	hash string
+	seq  uint64
+	refs int
+}
+
+// begin records the start of a fetch of the object for hash, whose results
+// may be stored. The caller must call done on the token when it is finished.
+func (t *storeTracker) begin(hash string) *storeToken {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ks, ok := t.keys[hash]
+	if !ok {
+		if t.keys == nil {
+			t.keys = make(map[string]*keyStores)
+		}
+		ks = &keyStores{idle: make(chan struct{})}
+		t.keys[hash] = ks
+	}
+	ks.active++
+	return &storeToken{t: t, hash: hash, seq: t.seq, refs: 1}
+}
+
+// hold adds a reference to tok, for a store that will complete after the
+// caller is done. Each hold must be matched by a call to done.
+func (tok *storeToken) hold() {
+	if tok == nil {
+		return
+	}
+	tok.t.mu.Lock()
+	defer tok.t.mu.Unlock()
+	tok.refs++
+}
+
+// done releases a reference to tok. When the last is released, the fetch and
+// its stores are no longer in progress.
+func (tok *storeToken) done() {
+	if tok == nil {
+		return
+	}
+	t := tok.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tok.refs--; tok.refs > 0 {
+		return
+	}
+	ks := t.keys[tok.hash]
+	if ks.active--; ks.active == 0 {
+		close(ks.idle)
+		delete(t.keys, tok.hash)
+	}
+}
+
+// cancelled reports whether the object of tok has been purged by a purge with
+// the PurgeCancelsStores policy since tok began.
+func (tok *storeToken) cancelled() bool {
+	if tok == nil {
+		return false
+	}
+	tok.t.mu.Lock()
+	defer tok.t.mu.Unlock()
+	ks := tok.t.keys[tok.hash]
+	return ks != nil && ks.purged > tok.seq
+}
+
+// cancel marks the stores in progress for hash, if any, as cancelled.
+func (t *storeTracker) cancel(hash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	if ks, ok := t.keys[hash]; ok {
+		ks.purged = t.seq
+	}
+}
+
+// wait waits until no stores for hash are in progress, or until ctx ends.
+func (t *storeTracker) wait(ctx context.Context, hash string) error {
+	t.mu.Lock()
+	ks, ok := t.keys[hash]
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-ks.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// storeCancelled reports whether tok is cancelled, and if so records that the
+// store to the named tier was skipped.
+func (s *Server) storeCancelled(tok *storeToken, tier string) bool {
+	if !tok.cancelled() {
+		return false
+	}
+	s.purgeCancelStore.Add(1)
+	s.vlogf("skip store %q %s: purged", tok.hash, tier)
+	return true
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setAcceptRanges sets the Accept-Ranges header h of a cached response to r,
+// according to whether we can serve a range of it, and if r requests one that
+// we can serve, applies it. It returns the reader for the body to send.
+//
+// Only a complete 200 object whose body is held in memory can be served in
+// ranges, and then only if AdvertiseRanges is set. Otherwise "none" is sent,
+// since we would ignore the Range, unless CachePartialContent is set, since
+// then a range request is forwarded to the origin.
+func (s *Server) setAcceptRanges(r *http.Request, h http.Header, body io.Reader) io.Reader {
+	h.Del("Accept-Ranges")
+	if cachedStatus(h) != http.StatusOK || h.Get("Content-Range") != "" {
+		return body
+	}
+	br, ok := body.(*bytes.Reader)
+	if !ok || !s.AdvertiseRanges {
+		if !s.CachePartialContent {
+			h.Set("Accept-Ranges", "none")
+		}
+		return body
+	}
+	h.Set("Accept-Ranges", "bytes")
+	if isNotModified(r, h) || !ifRangeMatches(r, h) {
+		return body
+	}
+	size := br.Size()
+	start, end, ok := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		return body // no range, or one we do not support
+	} else if start >= size {
+		h.Set(statusHeader, strconv.Itoa(http.StatusRequestedRangeNotSatisfiable))
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		h.Set("Content-Length", "0")
+		return strings.NewReader("")
+	}
+	h.Set(statusHeader, strconv.Itoa(http.StatusPartialContent))
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	return io.NewSectionReader(br, start, end-start+1)
+}
+
+// ifRangeMatches reports whether the If-Range condition of r, if any, is
+// satisfied by a cached object with header h. Following RFC 7233 Section 3.2,
+// an entity tag must match by strong comparison, and a date must match the
+// Last-Modified time exactly.
+func ifRangeMatches(r *http.Request, h http.Header) bool {
+	v := r.Header.Get("If-Range")
+	if v == "" {
+		return true
+	} else if strings.HasPrefix(v, `"`) {
+		etag := h.Get("Etag")
+		return etag == v
+	}
+	return v == h.Get("Last-Modified")
+}
+
+// parseRange parses the Range header value v for a body of the given size.
+// It reports false if v is not a single, well-formed byte range. Otherwise it
+// returns the first and last byte positions requested, where start >= size
+// if the range cannot be satisfied.
+func parseRange(v string, size int64) (start, end int64, ok bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(v), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+	if first == "" {
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		} else if n == 0 {
+			return size, size, true // unsatisfiable
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// isConsistentFragment reports whether the partial response rsp answers the
+// single byte range its request asked for: Its Content-Range must be
+// well-formed, cover that range, and agree with the length of the body, if
+// known. Otherwise the fragment may be from another version of the object or
+// for another range, and it is not cached.
+func isConsistentFragment(rsp *http.Response) bool {
+	spec, ok := strings.CutPrefix(rsp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return false
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return false
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return false
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return false
+	} else if rsp.ContentLength >= 0 && rsp.ContentLength != end-start+1 {
+		return false
+	} else if total == "*" {
+		return true
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || end >= size {
+		return false
+	}
+	wantStart, wantEnd, ok := parseRange(rsp.Request.Header.Get("Range"), size)
+	return ok && start == wantStart && end == wantEnd
+}
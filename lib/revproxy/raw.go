@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+
+	"gocloud.dev/gcerrors"
+)
+
+// RawHandler returns a [http.Handler] that serves the raw stored form of a
+// cached object, for diagnosing format or corruption issues: its header
+// section and body exactly as written to the local cache or to S3.
+//
+// The object is selected by its cache key, given by the "hash" query
+// parameter, and the tier by the optional "tier" parameter, "local" or "s3".
+// By default the local cache is tried first, then S3. The object is served as
+// application/octet-stream, with the tier it was read from in the
+// X-Cache-Tier header. Objects in the memory cache are not stored in a raw
+// form, and are not served.
+//
+// The handler does no access control of its own. Since it exposes cached
+// content, the caller must serve it only to trusted clients, for example by
+// registering it with an access-controlled debug handler.
+func (s *Server) RawHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.init()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		hash, tier := r.URL.Query().Get("hash"), r.URL.Query().Get("tier")
+		if !isObjectHash(hash) {
+			http.Error(w, "invalid or missing hash", http.StatusBadRequest)
+			return
+		} else if tier != "" && tier != "local" && tier != "s3" {
+			http.Error(w, "invalid tier", http.StatusBadRequest)
+			return
+		}
+
+		var rc io.ReadCloser
+		var size int64
+		err := fs.ErrNotExist
+		if tier != "s3" && s.Local != "" {
+			var f *os.File
+			if f, err = os.Open(s.makePath(hash)); err == nil {
+				if fi, serr := f.Stat(); serr == nil {
+					rc, size, tier = f, fi.Size(), "local"
+				} else {
+					f.Close()
+					err = serr
+				}
+			}
+		}
+		if rc == nil && tier != "local" && errors.Is(err, fs.ErrNotExist) {
+			rd, rerr := s.openS3(r.Context(), hash)
+			if rerr == nil {
+				rc, size, tier = rd, rd.Size(), "s3"
+			}
+			err = rerr
+		}
+		if rc == nil {
+			if errors.Is(err, fs.ErrNotExist) || gcerrors.Code(err) == gcerrors.NotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			} else {
+				s.logf("raw %q: %v", hash, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		defer rc.Close()
+
+		h := w.Header()
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		h.Set("Content-Disposition", `attachment; filename="`+hash+`"`)
+		h.Set("X-Cache-Tier", tier)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.Copy(w, rc); err != nil {
+			s.logf("raw %q: copy: %v", hash, err)
+		}
+	})
+}
+
+// isObjectHash reports whether hash has the form of a cache key: the
+// hexadecimal SHA-256 digest produced by hashRequest.
+func isObjectHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
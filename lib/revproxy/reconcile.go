@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+
+	"github.com/creachadair/scheddle"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/time/rate"
+)
+
+// ReconcilePolicy specifies which cache tier is authoritative when a [Server]
+// reconciles its tiers (see [Server.ReconcileInterval]).
+type ReconcilePolicy int
+
+const (
+	// ReconcileDisk treats the local cache as authoritative (the default). An
+	// object in the local cache that is missing from S3 is uploaded.
+	ReconcileDisk ReconcilePolicy = iota
+
+	// ReconcileS3 treats S3 as authoritative. An object in the local cache
+	// that is missing from S3 is removed, and one whose content differs from
+	// the copy in S3 is replaced by it.
+	ReconcileS3
+)
+
+const (
+	// defaultReconcileBatch is the default number of objects sampled in each
+	// round of reconciliation.
+	defaultReconcileBatch = 32
+
+	// reconcileRate is the maximum rate at which objects are reconciled, in
+	// objects per second, so that reconciliation does not compete with
+	// serving for the disk and the network.
+	reconcileRate = 10
+)
+
+// scheduleReconcile schedules the next round of reconciliation, if enabled.
+func (s *Server) scheduleReconcile() {
+	if s.ReconcileInterval <= 0 {
+		return
+	}
+	s.expire.After(s.ReconcileInterval, scheddle.Run(func() {
+		s.start(func() error {
+			defer s.scheduleReconcile()
+			s.reconcile(context.Background())
+			return nil
+		})
+	}))
+}
+
+// reconcile samples objects from the local cache, and makes the other tiers
+// consistent with each according to the ReconcilePolicy.
+func (s *Server) reconcile(ctx context.Context) {
+	if !s.diskAvailable() {
+		return
+	}
+	n := s.ReconcileBatch
+	if n <= 0 {
+		n = defaultReconcileBatch
+	}
+	lim := rate.NewLimiter(reconcileRate, 1)
+	for _, hash := range s.sampleLocal(n) {
+		if err := lim.Wait(ctx); err != nil {
+			return
+		}
+		s.reconcileOne(ctx, hash)
+	}
+}
+
+// sampleLocal returns the hashes of up to n objects chosen at random from the
+// local cache.
+func (s *Server) sampleLocal(n int) []string {
+	dirs, err := os.ReadDir(s.Local)
+	if err != nil {
+		s.logf("reconcile: %v", err)
+		return nil
+	}
+	var out []string
+	for _, i := range rand.Perm(len(dirs)) {
+		if len(out) >= n {
+			break
+		} else if d := dirs[i]; !d.IsDir() || len(d.Name()) != 2 {
+			continue // not a cache shard
+		}
+		files, err := os.ReadDir(filepath.Join(s.Local, dirs[i].Name()))
+		if err != nil {
+			continue
+		}
+		for _, j := range rand.Perm(len(files)) {
+			if len(out) >= n {
+				break
+			} else if f := files[j]; f.Type().IsRegular() && len(f.Name()) > 2 && f.Name()[0] != '.' {
+				out = append(out, f.Name())
+			}
+		}
+	}
+	return out
+}
+
+// reconcileOne makes the tiers consistent for the object with the given hash,
+// which was found in the local cache.
+func (s *Server) reconcileOne(ctx context.Context, hash string) {
+	s.reconcileChecked.Add(1)
+	body, hdr, err := s.cacheLoadLocal(hash)
+	if err != nil {
+		return // expired or unreadable; nothing to reconcile
+	}
+	sum := storedBody(hdr, body).Checksum()
+	b, key := s.bucket(hash), s.makeKey(hash)
+
+	switch s.ReconcilePolicy {
+	case ReconcileS3:
+		rbody, rhdr, err := s.readS3Object(ctx, hash)
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			if err := os.Remove(s.makePath(hash)); err == nil {
+				s.reconcileRepair.Add(1)
+				s.logf("reconcile %q: not in S3, removed local copy", hash)
+			}
+			sum = ""
+		} else if err != nil {
+			s.logf("reconcile %q: read S3: %v", hash, err)
+			return
+		} else if rsum := storedBody(rhdr, rbody).Checksum(); rsum != sum {
+			if err := s.cacheStoreLocal(hash, rhdr, rbody); err != nil {
+				s.logf("reconcile %q: update local: %v", hash, err)
+				return
+			}
+			s.reconcileRepair.Add(1)
+			s.logf("reconcile %q: replaced local copy from S3", hash)
+			sum = rsum
+		}
+
+	default:
+		ok, err := b.Exists(ctx, key)
+		if err != nil {
+			s.logf("reconcile %q: check S3: %v", hash, err)
+			return
+		} else if !ok {
+			if err := s.cacheStoreS3(hash, hdr, body)(); err == nil {
+				s.reconcileRepair.Add(1)
+				s.logf("reconcile %q: uploaded missing S3 copy", hash)
+			}
+		}
+	}
+
+	// A memory entry that does not match the authoritative copy is removed,
+	// so that the next request will fault it in again. Entries whose bodies
+	// were demoted are read from the local cache, so they always match.
+	if e, ok := s.memGet(hash); ok && !e.onDisk && bytesBody(e.body).Checksum() != sum {
+		s.memRemove(hash)
+		s.reconcileRepair.Add(1)
+		s.logf("reconcile %q: removed mismatched memory entry", hash)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/creachadair/mds/mapset"
+)
+
+// redirectTransport is a [http.RoundTripper] that follows redirects from the
+// origin, so that the response to a request is the final resource rather than
+// the redirect. At most hops redirects are followed for each request.
+type redirectTransport struct {
+	s    *Server
+	base http.RoundTripper
+	hops int
+}
+
+// isRedirect reports whether code is a redirect status with a Location.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+//
+// If the redirect limit is reached, or a redirect leads back to a URL already
+// visited, the last redirect is returned as the response unchanged.
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := t.base.RoundTrip(req)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return rsp, err
+	}
+	seen := mapset.New(req.URL.String())
+	for hop := 0; isRedirect(rsp.StatusCode); hop++ {
+		loc, err := rsp.Location()
+		if err != nil {
+			return rsp, nil // no usable Location; let the client sort it out
+		} else if hop >= t.hops {
+			t.s.logf("redirect %q: stopped after %d hops", req.URL, hop)
+			return rsp, nil
+		} else if seen.Has(loc.String()) {
+			t.s.reqRedirectLoop.Add(1)
+			t.s.logf("redirect %q: loop at %q", req.URL, loc)
+			return rsp, nil
+		}
+		seen.Add(loc.String())
+
+		io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+
+		next := req.Clone(req.Context())
+		next.URL, next.Host = loc, loc.Host
+		if loc.Host != req.URL.Host {
+			// Don't pass credentials on to another host.
+			next.Header.Del("Authorization")
+			next.Header.Del("Cookie")
+		}
+		t.s.reqRedirectFollow.Add(1)
+		t.s.vlogf("rp redirect %q -> %q", req.URL, loc)
+		if rsp, err = t.base.RoundTrip(next); err != nil {
+			return nil, err
+		}
+	}
+	return rsp, nil
+}
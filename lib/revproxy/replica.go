@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"gocloud.dev/blob"
+)
+
+// replicaRetryDelay is how long to wait before retrying a failed write to a
+// replica bucket, when ReplicaRetry is enabled.
+const replicaRetryDelay = 5 * time.Second
+
+// storeReplicas writes the object for hash, with header hdr and the contents
+// of body, to its primary bucket and to each of the ReplicaBuckets
+// concurrently. It reports an error if the primary write fails, or if fewer
+// than ReplicaQuorum of the replica writes succeed.
+//
+// Failed replica writes are logged, and if ReplicaRetry is set, retried once
+// in the background.
+func (s *Server) storeReplicas(ctx context.Context, hash string, hdr http.Header, body *bodyBuffer) error {
+	errs := make([]error, len(s.ReplicaBuckets))
+	g := taskgroup.New(nil)
+	var perr error
+	g.Go(func() error {
+		perr = s.putPrimary(ctx, hash, hdr, body)
+		return nil
+	})
+	for i, b := range s.ReplicaBuckets {
+		g.Go(func() error {
+			errs[i] = s.putReplica(ctx, i, b, hash, hdr, body)
+			return nil
+		})
+	}
+	g.Wait()
+
+	var ok int
+	var failed []int
+	for i, err := range errs {
+		if err == nil {
+			ok++
+		} else {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) != 0 && s.ReplicaRetry {
+		s.retryReplicas(hash, hdr, body, failed)
+	}
+	if perr != nil {
+		return perr
+	} else if ok < s.ReplicaQuorum {
+		s.rspPushError.Add(1)
+		s.logf("[s3] put %q: %d of %d replicas written, want %d", hash, ok, len(errs), s.ReplicaQuorum)
+		return fmt.Errorf("put %q: replica quorum not reached (%d < %d)", hash, ok, s.ReplicaQuorum)
+	}
+	return nil
+}
+
+// putReplica writes the object for hash to replica bucket i, b.
+func (s *Server) putReplica(ctx context.Context, i int, b *blob.Bucket, hash string, hdr http.Header, body *bodyBuffer) error {
+	n, err := s.putS3(ctx, b, hash, hdr, body)
+	if errors.Is(err, errNewerStored) {
+		return nil
+	} else if err != nil {
+		s.rspReplicaError.Add(1)
+		s.logf("[s3] put %q to replica %d failed: %v", hash, i, err)
+		return err
+	}
+	s.rspReplicaPush.Add(1)
+	s.rspPushBytes.Add(n)
+	return nil
+}
+
+// retryReplicas starts a background task to retry the writes of the object for
+// hash to the replica buckets at the given indexes, after a delay. Since body
+// is closed once the original write is done, its contents are copied.
+func (s *Server) retryReplicas(hash string, hdr http.Header, body *bodyBuffer, failed []int) {
+	data, err := body.Bytes()
+	if err != nil {
+		s.logf("[s3] retry %q to replicas: %v", hash, err)
+		return
+	}
+	data, algo := append([]byte(nil), data...), body.algo
+	s.start(func() error {
+		time.Sleep(replicaRetryDelay)
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		defer cancel()
+		for _, i := range failed {
+			if s.putReplica(ctx, i, s.ReplicaBuckets[i], hash, hdr, bytesBodyAs(data, algo)) == nil {
+				s.logf("[s3] put %q to replica %d succeeded on retry", hash, i)
+			}
+		}
+		return nil
+	})
+}
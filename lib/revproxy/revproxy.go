@@ -15,10 +15,14 @@ package revproxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"expvar"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -29,6 +33,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/mds/cache"
@@ -37,6 +42,18 @@ import (
 	"github.com/creachadair/taskgroup"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// defaultReadOnlyHeader is the default request header used to mark a request
+// as read-only with respect to the cache.
+const defaultReadOnlyHeader = "X-Cache-Read-Only"
+
+// Values of the Warning header for stale responses (RFC 7234 Section 5.5).
+const (
+	warnStale              = `110 - "Response is Stale"`
+	warnRevalidationFailed = `111 - "Revalidation Failed"`
+	warnDisconnected       = `112 - "Disconnected Operation"`
 )
 
 // Server is a caching reverse proxy server that caches successful responses to
@@ -50,10 +67,16 @@ import (
 // In addition, a successful response that is not immutable and specifies a
 // max-age will be cached temporarily in-memory.
 //
+// A request that includes "min-fresh=N" in its Cache-Control is only served
+// from the cache if the cached object will remain fresh for at least N more
+// seconds. Otherwise, the request is forwarded to the target as a miss.
+//
 // # Cache Format
 //
 // A cached response is a file with a header section and the body, separated by
-// a blank line. Only a subset of response headers are saved.
+// a blank line. Only a subset of response headers are saved. The header
+// section also records the version of the format (X-Cache-Format), and a
+// SHA-256 digest of the body (X-Cache-Body-SHA256).
 //
 // # Cache Responses
 //
@@ -65,9 +88,29 @@ import (
 //   - "hit, remote": The response was faulted in from S3.
 //   - "fetch, cached": The response was forwarded to the target and cached.
 //   - "fetch, uncached": The response was forwarded to the target and not cached.
+//   - "hit, revalidated": A stale cached response was revalidated by the target.
+//   - "hit, stale": A stale cached response was served because the target is
+//     failing.
 //
 // For results intersecting with the cache, it also reports a X-Cache-Id giving
 // the storage key of the cache object.
+//
+// Responses served from the cache include an Age header giving the number of
+// seconds since the Date of the cached response.
+//
+// A cached object is served the same way from every tier: The same subset of
+// headers is stored in each, and the Date header is the one recorded when the
+// object was stored, so the Age header depends only on the object and the
+// time it is served. The only header that differs between tiers is X-Cache.
+//
+// If a cached response that is no longer fresh is served, it includes Warning
+// headers (RFC 7234 Section 5.5) describing why:
+//
+//   - 110 (Response is Stale): On all stale responses.
+//   - 111 (Revalidation Failed): The target failed, and the response permits
+//     stale-if-error (RFC 5861).
+//   - 112 (Disconnected Operation): The target is not being contacted because
+//     it is failing (see OriginErrorThreshold).
 type Server struct {
 	// Targets is the list of hosts for which the proxy should forward requests.
 	// Host names should be fully-qualified ("host.example.com").
@@ -82,10 +125,281 @@ type Server struct {
 	S3Client *s3util.Client
 	Bucket   *blob.Bucket
 
+	// S3Buckets, if non-empty, is a set of buckets across which cache entries
+	// are sharded, and Bucket is not used. Each key is assigned to one bucket
+	// by rendezvous hashing, so that adding a bucket to the end of the list
+	// moves only the keys that are assigned to the new bucket.
+	//
+	// The order of buckets is significant: Changing the order of existing
+	// buckets will reassign most keys.
+	S3Buckets []*blob.Bucket
+
+	// ReplicaBuckets, if non-empty, are buckets in other regions to which
+	// each object stored in S3 is also written, concurrently with the write to
+	// its primary bucket (Bucket, or one of S3Buckets). Objects are read from
+	// the primary bucket; a replica is read only if the primary bucket fails
+	// for a reason other than the object not existing.
+	ReplicaBuckets []*blob.Bucket
+
+	// ReplicaQuorum is the number of replica writes that must succeed, in
+	// addition to the write to the primary bucket, for an object to be stored
+	// successfully. Failure to reach the quorum is logged and counted as a
+	// failed write to S3. If zero, replica failures are only logged.
+	ReplicaQuorum int
+
+	// ReplicaRetry, if true, retries each failed replica write once in the
+	// background, after a short delay.
+	ReplicaRetry bool
+
 	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
 	// intervening slash.
 	KeyPrefix string
 
+	// PreserveHeaders are the names of response headers to store with cached
+	// objects and replay when serving them, in addition to the defaults
+	// (Cache-Control, Content-Type, Date, Etag, Last-Modified, and Vary, among
+	// others). Other response headers are not stored.
+	PreserveHeaders []string
+
+	// DropHeaders are the names of response headers that are never stored
+	// with cached objects, such as tracing or request IDs that should not be
+	// replayed to other clients. It takes precedence over PreserveHeaders and
+	// the defaults, except that Cache-Control and Date are always stored.
+	//
+	// The stored Vary header is normalized to a single list of canonical
+	// header names, and served with every hit for the object, including hits
+	// on a variant. Dropping it may cause downstream caches to serve the
+	// wrong variant of a response.
+	DropHeaders []string
+
+	// CacheOptionsRequests, if true, enables caching of the responses to CORS
+	// preflight requests (OPTIONS requests with Access-Control-Request-Method)
+	// in memory. Since a preflight response depends on the request, the cache
+	// key includes the Origin and Access-Control-Request-* request headers.
+	// The Access-Control-* response headers are stored with the response.
+	//
+	// A preflight response is cached for its max-age if it has one, and
+	// otherwise for its Access-Control-Max-Age, up to one hour. In the latter
+	// case, the cached copy is served with a corresponding max-age.
+	CacheOptionsRequests bool
+
+	// CacheNoContent, if true, permits responses with status 204 (No Content)
+	// to be cached under the same conditions as responses with status 200.
+	// The status is recorded with the cached object, and replayed when it is
+	// served.
+	CacheNoContent bool
+
+	// StatusClassTTL, if non-empty, gives default freshness lifetimes for
+	// responses by status class, keyed by the leading digit of the status
+	// (2, 3, 4, or 5). A response in a class listed here may be cached, and if
+	// it has no explicit freshness lifetime (s-maxage, max-age, or Expires),
+	// it is stored with a lifetime of the given duration, as if the origin
+	// had sent a max-age; the Cache-Control sent to clients is unchanged.
+	// This permits caching redirects and errors, which origins often do not
+	// annotate. Responses with status 206 or 304 are never cached this way.
+	StatusClassTTL map[int]time.Duration
+
+	// CachePartialContent, if true, enables caching of 206 (Partial Content)
+	// responses to requests for a single byte range. Such a response is
+	// cached as a fragment, under a key that includes the requested range, so
+	// it is only used to serve later requests for the same range of the same
+	// object, never for the complete object or for other ranges. Fragments
+	// are not assembled into complete objects. A fragment is cached only if
+	// its Content-Range matches the range requested and the length of its
+	// body, so that one from another version of the object, whose size has
+	// changed, is not stored.
+	//
+	// If false (the default), partial responses are not cached. In either
+	// case, a response with a Content-Range header is never stored as if it
+	// were the complete object.
+	CachePartialContent bool
+
+	// S3ReadValidate, if true, checks each object read from S3 against its
+	// recorded checksum and expiry. If the object is corrupt, expired, or
+	// stale, as may happen when reading from a lagging replica, the read is
+	// retried once after a short delay. An object that is still corrupt is
+	// treated as a cache miss. Failed validations are logged, and counted in
+	// the "req_s3_invalid" metric.
+	S3ReadValidate bool
+
+	// BodyEvictFirst, if true, changes how entries are evicted from the memory
+	// cache when it is full: Rather than discarding an unexpired entry, its
+	// body is moved to the local cache, and its headers are kept in memory.
+	// A later request for the entry reads the body from disk, or revalidates
+	// the entry with the origin, as usual.
+	BodyEvictFirst bool
+
+	// CanonicalHost, if non-empty, replaces the host of each request URL when
+	// computing its cache key, so that requests for the same path on any of
+	// the targets share a cache entry. Use this when the targets are aliases
+	// for the same origin. It does not affect the request sent to the origin.
+	// It is applied before any Canonicalizers.
+	CanonicalHost string
+
+	// MemoryPressureCheck, if non-nil, is called periodically (at most once a
+	// second, while requests are being served) to report whether the system is
+	// under memory pressure, for example from cgroup pressure stall
+	// information. When it reports true, all entries are evicted from the
+	// memory cache. With BodyEvictFirst, their bodies are moved to the local
+	// cache.
+	MemoryPressureCheck func() bool
+
+	// PrecomputeVariants are content encodings (currently only "gzip" is
+	// supported) in which to store additional variants of objects cached on
+	// disk and in S3. When an object without a content encoding is stored, a
+	// background task encodes it in each of these, and stores the results as
+	// separate objects. A request whose Accept-Encoding prefers one of these
+	// encodings to none, by its quality values, is served the variant it
+	// prefers most, if available, so that responses need not be compressed
+	// at serve time. An encoding the request excludes with q=0 is not served.
+	//
+	// Brotli ("br") is not implemented. [Server.Validate] reports an error
+	// for it, or for any other unsupported encoding, which is otherwise
+	// ignored.
+	//
+	// Such objects are served with "Vary: Accept-Encoding", whether or not
+	// from a variant, and a variant has its own ETag, derived from that of
+	// the object. When the object is refreshed and no longer gets a variant
+	// in some encoding, as when it is no longer compressible, the old
+	// variant is removed.
+	PrecomputeVariants []string
+
+	// DirectS3ServeThreshold, if positive, is the size in bytes above which an
+	// object found in S3 is streamed directly to the client, rather than being
+	// loaded into memory and stored in the local cache. This keeps very large,
+	// rarely-requested objects from churning the local cache. The checksums of
+	// such objects are not verified.
+	DirectS3ServeThreshold int64
+
+	// DefaultMaxAge, if positive, is the freshness lifetime used for a
+	// response whose Cache-Control header has a max-age directive that is not
+	// a valid number. If zero, such a response is handled as if it had no
+	// max-age directive.
+	//
+	// Other malformed numeric directives do not use this default: Negative
+	// values are treated as zero, and conflicting values resolve to the most
+	// restrictive one.
+	DefaultMaxAge time.Duration
+
+	// MaxTiersConsulted, if positive, limits the number of cache tiers
+	// consulted for a request before it is forwarded to the origin. The tiers
+	// are consulted in order: memory (1), local disk (2), and S3 (3). For
+	// example, a value of 2 avoids the latency of an S3 lookup on a miss.
+	// Responses fetched from the origin are still stored in every tier they
+	// qualify for. If zero, all tiers are consulted.
+	MaxTiersConsulted int
+
+	// MaxTiersFunc, if non-nil, is called to choose the number of cache tiers
+	// to consult for each request, overriding MaxTiersConsulted. A result of
+	// zero or less means all tiers. This allows the limit to vary by path.
+	MaxTiersFunc func(*http.Request) int
+
+	// TraceRequests, if non-nil, is called for each request to decide whether
+	// to record a trace of the decisions made in handling it: the cache key,
+	// each tier consulted with its result and latency, the response from the
+	// origin, and where the response was stored. The trace of such a request
+	// is returned to the client in an X-Cache-Trace header, as base64-encoded
+	// JSON, and is also logged. Tracing can be enabled by a request header,
+	// or for a sample of requests.
+	TraceRequests func(*http.Request) bool
+
+	// ReconcileInterval, if positive, enables a background task that runs at
+	// this interval to sample objects from the local cache, and make the other
+	// tiers consistent with them according to ReconcilePolicy. This repairs
+	// drift between the tiers left by partial failures, such as an upload to
+	// S3 that did not complete. Reconciliation is rate-limited, and each
+	// repair is logged.
+	ReconcileInterval time.Duration
+
+	// ReconcilePolicy specifies which tier is authoritative during
+	// reconciliation. In either case, a memory cache entry whose content does
+	// not match the authoritative copy is removed.
+	ReconcilePolicy ReconcilePolicy
+
+	// ReconcileBatch is the number of objects sampled in each round of
+	// reconciliation. If zero or negative, a default of 32 is used.
+	ReconcileBatch int
+
+	// RevalidateImmutable, if true, disables the special handling of responses
+	// marked "Cache-Control: immutable" (RFC 8246). By default, a fresh
+	// immutable object is served from the cache even if the request asks for a
+	// fresher copy with min-fresh, since its content will not change before it
+	// expires. Either way, the immutable directive is passed on to clients, and
+	// an expired immutable object is revalidated like any other.
+	RevalidateImmutable bool
+
+	// KeyBodyContentTypes, if non-empty, lists the media types (for example,
+	// "application/json") of POST requests whose responses may be cached. The
+	// body of such a request is included in its cache key, as for an RPC-style
+	// API. The body is read once, and replayed to the origin on a miss. Other
+	// POST requests are not cached.
+	KeyBodyContentTypes []string
+
+	// KeyBodyMaxBytes, if positive, is the largest request body included in
+	// the cache key for KeyBodyContentTypes. A request with a larger body is
+	// forwarded to the origin without caching. If zero, a default of 64 KiB is
+	// used.
+	KeyBodyMaxBytes int64
+
+	// CORSOrigins, if non-empty, lists the origins allowed to make cross-origin
+	// requests for cached content, or "*" to allow any origin. When set, the
+	// Access-Control-Allow-Origin header of each response is set at serve time
+	// to the Origin of the request if it is allowed, and removed otherwise,
+	// regardless of what the origin server sent when the object was cached.
+	// Responses to CORS preflight requests are not affected.
+	CORSOrigins []string
+
+	// TransformResponseHeaders, if non-nil, is called with the headers of every
+	// response just before they are written to the client, whether it is
+	// served from the cache or fetched from the origin, and may modify them,
+	// for example to add security headers. It runs after the cache has set
+	// its own headers, including Age and X-Cache, so it can also amend or
+	// remove those. Changes affect only the response to this client: They are
+	// not stored in the cache.
+	TransformResponseHeaders func(http.Header)
+
+	// NormalizeError, if non-nil, is called for each response from the origin
+	// with an error status (4xx or 5xx), before it is cached or served. If it
+	// returns a non-nil response, that response is used in place of the
+	// original, for example to rewrite an HTML error page into a JSON error.
+	// The replacement is cached as the original would have been, if its
+	// status permits. If the replacement has a different body, the original
+	// body is closed.
+	NormalizeError func(*http.Response) *http.Response
+
+	// UpstreamURL, if non-nil, is called to choose the URL to which a request
+	// is forwarded when it cannot be served from the cache. This allows the
+	// proxy to route requests to different origins, or to rewrite their paths
+	// or queries. If it reports an error, the client receives a 502 (Bad
+	// Gateway) response. If nil, a request is forwarded to its own URL.
+	//
+	// The cache key is computed from the incoming request, and not from the
+	// URL returned, so requests that route to different content must differ
+	// in their URLs, or in some other part of the key (see KeySalt).
+	UpstreamURL func(*http.Request) (*url.URL, error)
+
+	// BypassOnCookies, if non-empty, names cookies whose presence on a request
+	// causes it to bypass the cache entirely: The request is forwarded to the
+	// origin, and the response is neither served from nor stored in the cache.
+	// Naming a session cookie here caches anonymous traffic only, which is
+	// simpler and safer than including cookies in the cache key.
+	BypassOnCookies []string
+
+	// SelfHealCorruption reports whether corrupt cache objects are repaired.
+	// If nil, self-healing is enabled. When an object read from the local
+	// cache or S3 is found to be corrupt, because it cannot be parsed or (see
+	// S3ReadValidate) its body does not match its checksum, it is removed from
+	// every tier and the request is forwarded to the origin, which stores a
+	// fresh copy. Each such repair is logged with the cache key. If it points
+	// to false, the corrupt object is treated as a miss, and left in place.
+	SelfHealCorruption *bool
+
+	// KeySalt, if non-empty, is mixed into the cache key of every request, so
+	// that servers with different salts sharing the same local directory or
+	// bucket never use each other's cache entries. Changing the salt
+	// effectively invalidates the entire cache.
+	KeySalt string
+
 	// Logf, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
 	Logf func(string, ...any)
@@ -109,48 +423,585 @@ type Server struct {
 	//
 	// The dispositions of a request are:
 	//
-	//     hit mem  -- cache hit in memory (volatile)
-	//     hit disk -- cache hit in local disk
-	//     hit S3   -- cache hit in S3 (faulted to disk)
-	//     fetch    -- fetched from the origin server
+	//     hit mem   -- cache hit in memory (volatile)
+	//     hit disk  -- cache hit in local disk
+	//     hit S3    -- cache hit in S3 (faulted to disk)
+	//     hit stale -- stale cache hit while the origin is unavailable
+	//     fetch     -- fetched from the origin server
+	//     backoff   -- rejected while the origin is unavailable
 	//
 	// On fetches, the "RC" tag indicates whether the response is cacheable,
 	// with "no" meaning it was not cached at all, "mem" meaning it was cached
 	// as a short-lived volatile response in memory, and "yes" meaning it was
-	// cached on disk (and S3).
+	// cached on disk (and S3). With ContentHashRevalidation, "same" means the
+	// response matched the stored object, and was not re-uploaded to S3.
 	LogRequests bool
 
-	initOnce sync.Once
-	tasks    *taskgroup.Group
-	start    func(taskgroup.Task)
-	mcache   *cache.Cache[string, memCacheEntry] // short-lived mutable objects
-	expire   *scheddle.Queue                     // cache expirations
-
-	reqReceived  expvar.Int // total requests received
-	reqMemoryHit expvar.Int // hit in memory cache (volatile)
-	reqLocalHit  expvar.Int // hit in local cache
-	reqLocalMiss expvar.Int // miss in local cache
-	reqFaultHit  expvar.Int // hit in remote (S3) cache
-	reqFaultMiss expvar.Int // miss in remote (S3) cache
-	reqForward   expvar.Int // request forwarded directly to upstream
-	rspSave      expvar.Int // successful response saved in local cache
-	rspSaveMem   expvar.Int // response saved in memory cache
-	rspSaveError expvar.Int // error saving to local cache
-	rspSaveBytes expvar.Int // bytes written to local cache
-	rspPush      expvar.Int // successful response saved in S3
-	rspPushError expvar.Int // error saving to S3
-	rspPushBytes expvar.Int // bytes written to S3
-	rspNotCached expvar.Int // response not cached anywhere
+	// ContentHashRevalidation, if true, enables revalidation of stale cached
+	// objects by content checksum when the origin does not provide an ETag.
+	// The response body is fetched in full, but if its checksum matches that
+	// of the stored object, only the header of the local copy is refreshed:
+	// The body is not written to the local cache or uploaded to S3 again. If
+	// there is no local copy to refresh, the object is stored in full, so that
+	// the lifetime of the copy in S3 is extended as well.
+	ContentHashRevalidation bool
+
+	// HotKeyThreshold, if positive, enables protection for hot keys: A key
+	// requested at least this many times per second is considered hot.  When a
+	// memory cache entry for a hot key expires, it continues to be served
+	// (stale) for up to HotKeyMaxStale while a refresh is fetched from the
+	// origin in the background.  The current hot keys are reported in the
+	// "hot_keys" field of the metrics, and stale serves in "req_memory_stale".
+	// Background refreshes, here and for EarlyExpirationBeta, are reported in
+	// the "refresh_*" fields: those started, succeeded, failed, and still in
+	// progress, and their total duration in milliseconds.
+	HotKeyThreshold float64
+
+	// HotKeyMaxStale is the maximum length of time past expiry that a memory
+	// cache entry for a hot key may be served. If zero, a default of 30 seconds
+	// is used. It has no effect unless HotKeyThreshold is positive.
+	HotKeyMaxStale time.Duration
+
+	// EarlyExpirationBeta, if positive, enables probabilistic early refresh
+	// of cached objects (the "XFetch" algorithm): As an object nears expiry,
+	// each hit has an increasing chance of starting a refresh from the origin
+	// in the background, so that refreshes of popular objects are spread out
+	// rather than all arriving when they expire. The chance is scaled by how
+	// long the object took to fetch, and by this factor; 1 is a reasonable
+	// default, and larger values refresh earlier.
+	EarlyExpirationBeta float64
+
+	// RetainMetadataAfterExpiry, if positive, is how long a memory cache entry
+	// with a validator (ETag or Last-Modified) is retained after it expires.
+	// Only the header of a retained entry is kept: Its body is dropped once
+	// the entry is past any window in which it may be served stale (see
+	// HotKeyMaxStale). A request for a retained entry is sent to the origin
+	// as a conditional request, and if the origin reports the object is not
+	// modified, the body is read from the local cache or S3, served, and its
+	// lifetime renewed, rather than fetching the whole object again. If no
+	// copy of the body with the same validators is stored, the object is
+	// fetched again in full.
+	//
+	// Retained entries remain subject to eviction when the memory cache is
+	// full.
+	RetainMetadataAfterExpiry time.Duration
+
+	// SynthesizeLastModified, if true, sets the Last-Modified header of a
+	// cached response that has neither an ETag nor a Last-Modified header from
+	// the origin, to the time the object was first stored. This permits
+	// clients to revalidate with If-Modified-Since. The synthesized time is
+	// stored with the object, and is kept when the object is refreshed if its
+	// content has not changed.
+	SynthesizeLastModified bool
+
+	// OnVersionMismatch specifies how to handle a cache object on disk or in
+	// S3 written in a newer format than this server understands, as may
+	// happen while a new version is being rolled out. The default is to treat
+	// such objects as a cache miss. Mismatches are counted in the
+	// "req_version_mismatch" metric.
+	OnVersionMismatch VersionPolicy
+
+	// CoalesceTimeout, if positive, bounds how long a request waits for a
+	// concurrent fetch of the same object to finish. Concurrent cache misses
+	// for the same object are coalesced, so that only one request (the leader)
+	// fetches from the origin while the others wait, then check the cache
+	// again. A waiting request that exceeds this timeout instead fetches the
+	// object independently, and may also update the cache. If zero, requests
+	// wait until the leader finishes.
+	CoalesceTimeout time.Duration
+
+	// MaxAgeHeader, if positive, is the largest value reported in the Age
+	// header of responses served from the cache. Older objects are reported
+	// as having this age. This does not affect the age used to decide whether
+	// an object is fresh.
+	MaxAgeHeader time.Duration
+
+	// OmitAgeHeaderAfter, if positive, suppresses the Age header on responses
+	// served from the cache for objects older than this.
+	OmitAgeHeaderAfter time.Duration
+
+	// ReadOnlyHeader is the name of a request header that, if present with a
+	// non-empty value, prevents the response to that request from being
+	// stored in the cache. Such requests may still be served from the cache.
+	// The header is removed from requests forwarded to the origin. If empty,
+	// the default is "X-Cache-Read-Only".
+	ReadOnlyHeader string
+
+	// DiskTTLMultiplier and S3TTLMultiplier scale how long objects are
+	// retained on local disk and in S3, respectively, relative to their
+	// freshness lifetime (max-age). If zero or negative, 1 is used. Objects
+	// without a max-age are retained indefinitely.
+	//
+	// A retained object is served only while it is fresh. After that, it may
+	// still be used for revalidation or stale serving, until its retention
+	// expires.
+	DiskTTLMultiplier float64
+	S3TTLMultiplier   float64
+
+	// LanguageKeyDepth, if positive, adds the client's preferred language from
+	// the Accept-Language request header to the cache key, for origins that
+	// localize their responses. The most preferred language tag is used,
+	// truncated to this many subtags and ignoring case, so that for example
+	// with depth 1 "en-US,en;q=0.9" and "en-gb" share a cache entry.
+	LanguageKeyDepth int
+
+	// SpillThreshold, if positive, is the size in bytes above which the body
+	// of a response being fetched for the cache is buffered in a temporary
+	// file in the Local directory, rather than in memory. This bounds memory
+	// use while fetching large objects. If zero, bodies are always buffered
+	// in memory.
+	SpillThreshold int64
+
+	// OriginErrorThreshold, if positive, enables a circuit breaker for the
+	// origin: If requests to the origin fail (with a transport error or a 5xx
+	// status) at least this many times per second, the proxy stops sending it
+	// requests, and serves stale cached copies of objects with a Warning
+	// header instead. Requests for objects with no cached copy fail with 503
+	// (Service Unavailable). After a backoff that grows while the origin
+	// continues to fail, a single request is sent to probe whether it has
+	// recovered, and if it succeeds, normal operation resumes.
+	OriginErrorThreshold float64
+
+	// HedgeDelay, if positive, enables hedging of slow requests to the origin:
+	// If the origin has not responded to a GET, HEAD, or OPTIONS request
+	// within this time, a second copy of the request is sent, and whichever
+	// responds first is used. The other is canceled. Hedged requests are
+	// counted in the "req_hedged" metric.
+	HedgeDelay time.Duration
+
+	// HedgeLimit is the maximum number of hedged requests in flight at once.
+	// When the limit is reached, slow requests are not hedged, so that hedging
+	// does not amplify the load on an origin that is slow across the board. If
+	// zero, a default of 8 is used.
+	HedgeLimit int
+
+	// MaxPendingExpirations, if positive, limits the number of expirations
+	// of memory cache entries that are scheduled individually. Once the limit
+	// is reached, further entries are instead removed by a periodic sweep of
+	// the memory cache, so that the memory used by the scheduler is bounded
+	// regardless of the store rate or entry lifetimes. The number pending is
+	// reported in the "mem_expire_pending" metric.
+	MaxPendingExpirations int
+
+	// MemorySweepInterval is the interval between sweeps of the memory cache
+	// when MaxPendingExpirations is set. If zero or negative, a default of
+	// 1 minute is used.
+	MemorySweepInterval time.Duration
+
+	// PrewarmConnections, if positive, is the number of connections to each
+	// of the Targets opened by [Server.Prewarm] before serving begins.
+	PrewarmConnections int
+
+	// MaxPinnedBytes is the maximum total size of the bodies of the memory
+	// cache entries for pinned objects (see [Server.Pin]) that are exempt from
+	// eviction. If zero or negative, a default of 1 MiB is used.
+	MaxPinnedBytes int64
+
+	// EarlyHints, if true, enables use of 103 (Early Hints) responses. When
+	// the origin sends early hints, the targets of their rel=preload links are
+	// prefetched into the cache in the background (rate-limited by WarmRate).
+	// Cached responses keep their Link headers, and when one with preload
+	// links is served from the cache, its links are first sent to the client
+	// as early hints. The hints themselves are never cached.
+	//
+	// Early hints from the origin are relayed to the client by the reverse
+	// proxy whether or not this is set.
+	EarlyHints bool
+
+	// PreferFreshestTier, if true, makes the proxy compare the copy of an
+	// object found in the local cache with the copy in S3, and use whichever
+	// is fresher. This costs an extra read from S3 for each local hit, but
+	// avoids serving a stale local copy when a later write to the local cache
+	// failed, or the reverse. The staler tier is repaired in the background,
+	// and repairs are counted in the "tier_freshness_repair" metric.
+	PreferFreshestTier bool
+
+	// SequentialPrefetch, if non-nil, is called with the URL of each cacheable
+	// request, and may return the URL of the request likely to follow it,
+	// such as the next page of a paginated result. If the object for that
+	// request is in S3 but not in the local cache, it is copied to the local
+	// cache in the background, so that the next request finds it there. The
+	// origin is never contacted for a prefetch.
+	//
+	// Only one URL ahead is prefetched, and prefetched objects do not cause
+	// further prefetches, so chains of predictions cannot run away. A
+	// relative URL is resolved against the URL of the current request.
+	SequentialPrefetch func(currentKey string) (nextKey string, ok bool)
+
+	// DiskErrorThreshold, if positive, enables a circuit breaker for the local
+	// cache: If reads and writes of the local cache fail with I/O errors at
+	// least this many times per second, the local cache is disabled, and the
+	// proxy continues with only the memory cache and S3. Objects that would
+	// have been stored locally are stored in S3 only. While disabled, the
+	// local cache is probed periodically (see DiskProbeInterval), and when a
+	// probe succeeds, it is used again. The "disk_disabled" metric reports
+	// whether the local cache is currently disabled.
+	DiskErrorThreshold float64
+
+	// DiskProbeInterval is the interval between probes of a local cache
+	// disabled by DiskErrorThreshold. If zero or negative, a default of
+	// 30 seconds is used.
+	DiskProbeInterval time.Duration
+
+	// CollapseIdenticalVariants, if true, detects when a response stored in
+	// the local cache and S3 has the same body as another variant of the same
+	// URL, such as one for a different Accept-Language, and stores only a
+	// reference to the other variant's body. This mitigates origins that
+	// declare variation their responses do not have. A variant whose shared
+	// body has since changed or been removed is treated as a cache miss. The
+	// bytes not stored are counted in the "rsp_collapsed_bytes" metric.
+	CollapseIdenticalVariants bool
+
+	// FollowRedirects, if positive, is the maximum number of redirects from
+	// the origin that the proxy follows for a GET or HEAD request, so that the
+	// client receives the final resource directly, and it is cached under the
+	// key of the original request. If the limit is reached, or a redirect
+	// leads back to a URL already visited, the last redirect is served as-is.
+	// Redirects to other hosts are followed without Authorization or Cookie
+	// headers.
+	//
+	// If zero or negative, redirects are not followed, and a redirect (other
+	// than 303 See Other) is cached like any other response, if its
+	// Cache-Control permits. It is served from the cache with its original
+	// status and Location.
+	FollowRedirects int
+
+	// StreamChunkSize, if positive, is the size in bytes of the buffer used
+	// to stream object bodies to and from the local cache, S3, and clients.
+	// Larger buffers favor throughput for large objects, smaller ones save
+	// memory, since each stream in progress has its own. Values below 4 KiB
+	// are raised to 4 KiB. If zero or negative, a default of 32 KiB is used.
+	StreamChunkSize int
+
+	// CompressibilitySampleBytes, if positive, is the size of a sample taken
+	// from the start of an object body to estimate whether it is worth
+	// compressing, before any PrecomputeVariants are generated. If the sample
+	// does not compress by at least 10%, as for images or archives, no
+	// variants are stored for the object, and the "rsp_variant_incompressible"
+	// metric is incremented. A few KiB is typically enough. If zero or
+	// negative, every body is encoded in full, and a variant is stored only
+	// if it is smaller than the original.
+	CompressibilitySampleBytes int
+
+	// MaxConcurrentPurges, if positive, is the maximum number of calls to
+	// [Server.Purge] that run at once. Further calls wait their turn, so that
+	// a burst of purges, as after a deploy, does not compete with serving for
+	// the disk and S3. The number waiting is reported by the "purge_queued"
+	// metric. If zero or negative, purges are not limited.
+	MaxConcurrentPurges int
+
+	// AdvertiseRanges, if true, enables serving byte ranges of complete
+	// objects from the memory and local caches: A request for a single byte
+	// range is answered 206 (Partial Content) from the cached body, subject
+	// to If-Range, and such responses carry "Accept-Ranges: bytes".
+	//
+	// Otherwise, and for responses streamed from S3, the Range header of a
+	// request is ignored and the complete object is served, with
+	// "Accept-Ranges: none", unless CachePartialContent is set, in which case
+	// the header is omitted.
+	AdvertiseRanges bool
+
+	// FreshnessFunc, if non-nil, decides whether a cached object may be
+	// served, in place of the built-in rules based on its Cache-Control and
+	// Expires headers and the request's Cache-Control. It is called with the
+	// request, the stored headers of the object, and the time the object was
+	// generated, from its Date header (zero if it has none). If it reports
+	// fresh, the cached object is served. Otherwise, if it reports
+	// revalidate, the object is revalidated with the origin, and if not it is
+	// treated as a miss. The revalidate result is ignored if fresh is true.
+	//
+	// FreshnessFunc is consulted only for objects still retained by a cache
+	// tier, and does not affect how long objects are retained.
+	FreshnessFunc func(req *http.Request, storedHeaders http.Header, storedTime time.Time) (fresh, revalidate bool)
+
+	// ChecksumPolicy, if non-nil, chooses the algorithm used to record the
+	// checksum of the body of each object stored on disk and in S3, given its
+	// Content-Type and size in bytes, for example to use the cheaper
+	// [ChecksumCRC32C] for small objects. The size is -1 for a response that
+	// does not declare its Content-Length, since the algorithm is chosen
+	// before the body is read, and the checksum computed as it is copied to
+	// the client. The algorithm is recorded with the object, and used to
+	// verify it on read (see S3ReadValidate). If nil, [ChecksumSHA256] is
+	// used for all objects.
+	//
+	// Bodies are compared by the checksum of the new object, as when an
+	// object is refreshed with the same content, so the checksum of a stored
+	// body recorded with another algorithm is computed when needed. Only
+	// objects with SHA-256 digests share bodies (see
+	// CollapseIdenticalVariants).
+	ChecksumPolicy func(contentType string, size int64) ChecksumAlgorithm
+
+	// PurgeDedupWindow, if positive, is how long the result of a call to
+	// [Server.Purge] is shared with other calls to purge the same object, as
+	// when a webhook delivers the same invalidation more than once. Calls made
+	// while a purge is in progress, or within this duration after it ends,
+	// wait for it and report its result, and are counted by the
+	// "purge_deduplicated" metric. An object stored again within the window
+	// is therefore not purged by a duplicate, so keep the window short. If
+	// zero or negative, purges are not deduplicated.
+	PurgeDedupWindow time.Duration
+
+	// OnlyIfCachedMissStatus is the status code of the response to a request
+	// with the only-if-cached directive that cannot be served from the cache.
+	// If zero or invalid, 504 (Gateway Timeout) is used, as RFC 9111 Section
+	// 5.2.1.7 specifies. Some clients handle a 404 (Not Found) better, as may
+	// clients of a replica that only ever serves from its cache, for which
+	// the object simply does not exist. Requests without only-if-cached are
+	// forwarded to the origin on a miss, as usual.
+	OnlyIfCachedMissStatus int
+
+	// OnlyIfCachedMissBody, if non-nil, is the body of the response to an
+	// only-if-cached request that misses, served as text/plain. If nil, the
+	// text of the status is used.
+	OnlyIfCachedMissBody []byte
+
+	// MetricsSink, if non-nil, is called every MetricsInterval with a snapshot
+	// of the metrics of the server (see [Server.Stats]), so that they can be
+	// pushed to a collector such as StatsD, rather than published with
+	// [Server.Metrics] and scraped. Calls are made one at a time, from a
+	// background task. If MetricsSink is nil, or MetricsInterval is zero or
+	// negative, metrics are not delivered.
+	MetricsSink func(Stats)
+
+	// MetricsInterval is the interval between calls to MetricsSink.
+	MetricsInterval time.Duration
+
+	// StoreNoCache, if positive, enables storing responses with the no-cache
+	// Cache-Control directive and a validator (ETag or Last-Modified) in the
+	// memory cache, for this long. Unlike no-store, no-cache permits a
+	// response to be stored, but not used without first revalidating it with
+	// the origin. So every request for such an object is sent to the origin
+	// as a conditional request, and if it is not modified, the stored copy is
+	// served, saving the transfer of the body. If zero or negative, no-cache
+	// responses are not stored, as for no-store.
+	//
+	// In either case, an object with no-cache is never served from any tier
+	// without revalidation.
+	StoreNoCache time.Duration
+
+	// CostAwareEviction, if true, evicts entries from the memory cache by the
+	// GreedyDual-Size policy rather than least-recently used: Entries that
+	// took longer to fetch from the origin, for their size, are kept longer
+	// than those that were cheap to fetch, while entries that are not used
+	// still age out in time. The fetch time is recorded with each entry when
+	// it is stored.
+	CostAwareEviction bool
+
+	// PreventStaleOverwrite, if true, checks the Date of any copy of an object
+	// already stored on disk or in S3 before writing a new copy, and skips
+	// the write if the stored copy is newer, as when a slow background write
+	// to S3 completes after a later fetch or revalidation was stored. Skipped
+	// writes are counted in the "rsp_stale_overwrite_skipped" metric. This
+	// costs a read of the header of the stored object for each write.
+	PreventStaleOverwrite bool
+
+	// PurgeStoreOrdering specifies how a call to [Server.Purge] is ordered
+	// with fetches and stores of the same object in progress when it begins.
+	// The default, [PurgeUnordered], does not order them, so a fetch that
+	// began before the purge may store the object again after it. Setting
+	// [PurgeWaitsForStores] or [PurgeCancelsStores] ensures that it does not:
+	// the former by delaying the purge until they are done, and the latter by
+	// discarding what they fetched. Skipped stores are counted in the
+	// "purge_cancelled_store" metric.
+	PurgeStoreOrdering PurgeStoreOrdering
+
+	// Canonicalizers, if non-empty, are applied in order to a copy of each
+	// request URL to produce the URL used to compute its cache key, so that
+	// requests that differ in ways the origin ignores share a cache entry.
+	// The package provides [SortQuery], [DropQueryParams], [LowercaseHost],
+	// and [StripTrailingSlash], and callers may add their own. Like
+	// CanonicalHost, they do not affect the request sent to the origin.
+	Canonicalizers []func(*url.URL)
+
+	// MaxCoalesceBodyBytes is the largest Content-Length, in bytes, of an
+	// object whose concurrent fetches are coalesced (see CoalesceTimeout).
+	// When the response for a larger object arrives, the requests waiting
+	// for it are released to fetch the object independently, rather than
+	// waiting for the whole body to be buffered and stored. Responses of
+	// unknown length are always coalesced. If zero, a default of 64 MiB is
+	// used; if negative, there is no limit. Released requests are counted in
+	// the "req_coalesce_too_large" metric.
+	MaxCoalesceBodyBytes int64
+
+	// HeuristicFreshnessMax, if positive, enables heuristic freshness (RFC
+	// 9111 Section 4.2.2): A response with a Last-Modified time but no
+	// explicit freshness lifetime, and without the no-store or no-cache
+	// directives, is given a lifetime of HeuristicFreshnessFraction of the
+	// time from its Last-Modified to its Date, up to HeuristicFreshnessMax.
+	// The lifetime is recorded with the stored object; the Cache-Control
+	// header sent to clients is left as the origin sent it.
+	HeuristicFreshnessMax time.Duration
+
+	// HeuristicFreshnessFraction is the fraction of the time since an object
+	// was last modified for which it is considered fresh, when heuristic
+	// freshness is enabled (see HeuristicFreshnessMax). If zero or negative,
+	// a default of 0.1 is used.
+	HeuristicFreshnessFraction float64
+
+	// LegacyBufferBytes is the largest response body, in bytes, that is
+	// buffered in memory to give it a Content-Length when it is forwarded
+	// without one to an HTTP/1.0 client, which cannot receive a chunked
+	// response. A larger body is sent without a length, and the connection
+	// is closed at its end. If zero, a default of 16 MiB is used; if
+	// negative, such responses are never buffered.
+	LegacyBufferBytes int64
+
+	// MemoryIdleTimeout, if positive, enables time-to-idle eviction from the
+	// memory cache: An entry that has not been served for this long is
+	// removed, even if its lifetime has not ended, so that memory goes to the
+	// objects in current use rather than to everything fetched recently.
+	// Pinned entries are exempt. Copies in the local cache and S3 are kept for
+	// their full lifetime. Removals are counted in the "mem_idle_evicted"
+	// metric.
+	MemoryIdleTimeout time.Duration
+
+	// WarmRate, if positive, limits the rate of requests issued by
+	// [Server.Warm] and [Server.WarmFromReader], in requests per second. If
+	// zero or negative, a default of 10 requests per second is used.
+	WarmRate float64
+
+	initOnce   sync.Once
+	tasks      *taskgroup.Group
+	start      func(taskgroup.Task)
+	mcache     *cache.Cache[string, memCacheEntry] // short-lived mutable objects
+	mstore     *peekStore                          // the store of mcache
+	expire     *scheddle.Queue                     // cache expirations
+	hotKeys    keyRates                            // per-key request rates
+	flights    flightGroup                         // fetches in progress
+	origin     originHealth                        // origin error tracking
+	hedges     atomic.Int64                        // hedged requests in flight
+	hints      atomic.Int64                        // early hint prefetches in flight
+	sweepKeys  sweepSet                            // memory entries to sweep
+	idleSweep  sweepSet                            // memory entries to check for idleness
+	idlers     idleSet                             // last use of memory entries
+	pins       pinSet                              // pinned memory entries
+	prefetches prefetchSet                         // sequential prefetches in flight
+	disk       diskHealth                          // local cache error tracking
+	purges     purgeLimit                          // purges in progress
+	purgeDups  purgeGroup                          // purges to deduplicate
+	stores     storeTracker                        // fetches and stores in progress
+	removals   removalSet                          // explicit memory cache removals
+
+	initVariantIndex sync.Once
+	variantIndex     *cache.Cache[string, storedVariant] // latest variant per URL
+
+	lastPressureCheck atomic.Int64 // time of last memory pressure check (ns)
+	loggedMalformedCC atomic.Bool  // a malformed Cache-Control has been logged
+
+	reqReceived     expvar.Int // total requests received
+	reqMemoryHit    expvar.Int // hit in memory cache (volatile)
+	reqMemoryStale  expvar.Int // stale hit in memory cache for a hot key
+	reqLocalHit     expvar.Int // hit in local cache
+	reqLocalMiss    expvar.Int // miss in local cache
+	reqFaultHit     expvar.Int // hit in remote (S3) cache
+	reqFaultMiss    expvar.Int // miss in remote (S3) cache
+	reqForward      expvar.Int // request forwarded directly to upstream
+	rspSave         expvar.Int // successful response saved in local cache
+	rspSaveMem      expvar.Int // response saved in memory cache
+	rspDemoteMem    expvar.Int // memory cache body demoted to local cache
+	rspSaveVariant  expvar.Int // precomputed variant saved in local cache
+	rspSaveError    expvar.Int // error saving to local cache
+	rspSaveBytes    expvar.Int // bytes written to local cache
+	rspPush         expvar.Int // successful response saved in S3
+	rspPushError    expvar.Int // error saving to S3
+	rspPushBytes    expvar.Int // bytes written to S3
+	rspReplicaPush  expvar.Int // successful response saved in an S3 replica
+	rspReplicaError expvar.Int // error saving to an S3 replica
+	rspNotCached    expvar.Int // response not cached anywhere
+	rspSame         expvar.Int // response matched a stale object by checksum
+	rspRevalidated  expvar.Int // stale object revalidated by the origin (304)
+	rspMalformedCC  expvar.Int // response with a malformed Cache-Control header
+
+	reqVersionMismatch expvar.Int // cache object with an unsupported format version
+	reqCoalesced       expvar.Int // request waited for a concurrent fetch
+	reqCoalesceTimeout expvar.Int // request gave up waiting for a concurrent fetch
+	reqOriginTrip      expvar.Int // origin circuit opened due to errors
+	reqOriginStale     expvar.Int // stale object served while origin unavailable
+	reqOriginBackoff   expvar.Int // request rejected while origin unavailable
+	reqStaleOnError    expvar.Int // stale object served for an origin error
+	reqS3Invalid       expvar.Int // invalid object read from S3
+	reqHedged          expvar.Int // hedged request sent to the origin
+	reqHedgeWon        expvar.Int // hedged request responded first
+	memPressureEvict   expvar.Int // memory cache entries evicted for memory pressure
+	reqVariantHit      expvar.Int // hit on a precomputed variant
+	reqS3Direct        expvar.Int // hit in S3 streamed directly to the client
+	reqTierSkip        expvar.Int // lookup ended early by the tier limit
+	reconcileChecked   expvar.Int // objects checked by reconciliation
+	reconcileRepair    expvar.Int // repairs made by reconciliation
+	reqEarlyRefresh    expvar.Int // early refresh started for a fresh hit
+	reqSelfHeal        expvar.Int // corrupt object removed from all tiers
+	expirePending      expvar.Int // memory expirations scheduled and not yet run
+	memSweepRemove     expvar.Int // expired memory entries removed by a sweep
+	reqHintPrefetch    expvar.Int // prefetch requests issued for early hints
+	rspEarlyHints      expvar.Int // early hints sent for a cached response
+	tierFreshRepair    expvar.Int // tier repaired with a fresher copy from another
+	reqSeqPrefetch     expvar.Int // objects promoted from S3 by sequential prefetch
+	diskError          expvar.Int // I/O errors from the local cache
+	diskTrip           expvar.Int // local cache disabled due to errors
+	rspCollapsed       expvar.Int // variant stored as a reference to an identical body
+	rspCollapsedBytes  expvar.Int // body bytes not stored for collapsed variants
+	reqRedirectFollow  expvar.Int // origin redirects followed
+	reqRedirectLoop    expvar.Int // origin redirect loops detected
+	rspIncompressible  expvar.Int // variants skipped for an incompressible body
+	purgeDone          expvar.Int // purges completed
+	purgeQueued        expvar.Int // purges waiting to begin
+	purgeDeduped       expvar.Int // purges that shared the result of another
+	reqCacheOnlyMiss   expvar.Int // only-if-cached request not found in the cache
+	rspStaleOverwrite  expvar.Int // store skipped as a newer copy was already stored
+	purgeCancelStore   expvar.Int // store skipped as the object was purged
+	reqRefreshStart    expvar.Int // background refreshes started
+	reqRefreshOK       expvar.Int // background refreshes that succeeded
+	reqRefreshFail     expvar.Int // background refreshes that failed
+	reqRefreshActive   expvar.Int // background refreshes in progress
+	reqRefreshMillis   expvar.Int // total duration of background refreshes (ms)
+	reqCoalesceLarge   expvar.Int // request released from a fetch of a large object
+	memIdleEvict       expvar.Int // memory cache entries removed for being idle
 }
 
+// VersionPolicy specifies how a [Server] handles cache objects written in a
+// newer format than it understands.
+type VersionPolicy int
+
+const (
+	// VersionMiss treats a mismatched object as a cache miss (the default).
+	// The object is replaced when the response is fetched and stored again.
+	VersionMiss VersionPolicy = iota
+
+	// VersionParse attempts to use a mismatched object anyway, parsing it on
+	// a best-effort basis as if it were in the current format.
+	VersionParse
+
+	// VersionDelete removes a mismatched object from the tier where it was
+	// found, and treats it as a cache miss.
+	VersionDelete
+)
+
+// Validate reports an error if the configuration of s is not supported.
+// Unsupported settings are otherwise logged as warnings and ignored when s
+// begins serving.
+func (s *Server) Validate() error { return s.checkVariants() }
+
 func (s *Server) init() {
 	s.initOnce.Do(func() {
 		nt := runtime.NumCPU()
 		s.tasks, s.start = taskgroup.New(nil).Limit(nt)
-		s.mcache = cache.New(cache.LRU[string, memCacheEntry](10 << 20).
-			WithSize(entrySize),
-		)
+		s.mstore = &peekStore{store: newLRUStore()}
+		if s.CostAwareEviction {
+			s.mstore.store = newCostStore()
+		}
+		cfg := cache.LRU[string, memCacheEntry](10 << 20).WithSize(entrySize).WithStore(s.mstore)
+		if s.BodyEvictFirst {
+			cfg = cfg.OnEvict(s.evictMemory)
+		}
+		s.mcache = cache.New(cfg)
 		s.expire = scheddle.NewQueue(nil)
+		if err := s.checkVariants(); err != nil {
+			s.logf("warning: %v", err)
+		}
+		s.checkStreamChunkSize()
+		s.scheduleReconcile()
+		s.scheduleSweep()
+		s.scheduleMetrics()
 	})
 }
 
@@ -160,6 +1011,7 @@ func (s *Server) Metrics() *expvar.Map {
 	m := new(expvar.Map)
 	m.Set("req_received", &s.reqReceived)
 	m.Set("req_memory_hit", &s.reqMemoryHit)
+	m.Set("req_memory_stale", &s.reqMemoryStale)
 	m.Set("req_local_hit", &s.reqLocalHit)
 	m.Set("req_local_miss", &s.reqLocalMiss)
 	m.Set("req_fault_hit", &s.reqFaultHit)
@@ -167,12 +1019,67 @@ func (s *Server) Metrics() *expvar.Map {
 	m.Set("req_forward", &s.reqForward)
 	m.Set("rsp_save", &s.rspSave)
 	m.Set("rsp_save_memory", &s.rspSaveMem)
+	m.Set("rsp_demote_memory", &s.rspDemoteMem)
+	m.Set("rsp_save_variant", &s.rspSaveVariant)
 	m.Set("rsp_save_error", &s.rspSaveError)
 	m.Set("rsp_save_bytes", &s.rspSaveBytes)
 	m.Set("rsp_push", &s.rspPush)
 	m.Set("rsp_push_error", &s.rspPushError)
 	m.Set("rsp_push_bytes", &s.rspPushBytes)
+	m.Set("rsp_replica_push", &s.rspReplicaPush)
+	m.Set("rsp_replica_error", &s.rspReplicaError)
 	m.Set("rsp_not_cached", &s.rspNotCached)
+	m.Set("rsp_same_content", &s.rspSame)
+	m.Set("rsp_revalidated", &s.rspRevalidated)
+	m.Set("rsp_malformed_cache_control", &s.rspMalformedCC)
+	m.Set("req_version_mismatch", &s.reqVersionMismatch)
+	m.Set("req_coalesced", &s.reqCoalesced)
+	m.Set("req_coalesce_timeout", &s.reqCoalesceTimeout)
+	m.Set("req_origin_trip", &s.reqOriginTrip)
+	m.Set("req_origin_stale", &s.reqOriginStale)
+	m.Set("req_origin_backoff", &s.reqOriginBackoff)
+	m.Set("req_stale_on_error", &s.reqStaleOnError)
+	m.Set("req_s3_invalid", &s.reqS3Invalid)
+	m.Set("req_hedged", &s.reqHedged)
+	m.Set("req_hedge_won", &s.reqHedgeWon)
+	m.Set("mem_pressure_evict", &s.memPressureEvict)
+	m.Set("req_variant_hit", &s.reqVariantHit)
+	m.Set("req_s3_direct", &s.reqS3Direct)
+	m.Set("req_tier_skipped", &s.reqTierSkip)
+	m.Set("reconcile_checked", &s.reconcileChecked)
+	m.Set("reconcile_repaired", &s.reconcileRepair)
+	m.Set("req_early_refresh", &s.reqEarlyRefresh)
+	m.Set("req_self_heal", &s.reqSelfHeal)
+	m.Set("mem_expire_pending", &s.expirePending)
+	m.Set("mem_sweep_removed", &s.memSweepRemove)
+	m.Set("req_hint_prefetch", &s.reqHintPrefetch)
+	m.Set("rsp_early_hints", &s.rspEarlyHints)
+	m.Set("tier_freshness_repair", &s.tierFreshRepair)
+	m.Set("req_sequential_prefetch", &s.reqSeqPrefetch)
+	m.Set("disk_error", &s.diskError)
+	m.Set("disk_trip", &s.diskTrip)
+	m.Set("disk_disabled", expvar.Func(func() any { return !s.diskAvailable() }))
+	m.Set("rsp_collapsed_variant", &s.rspCollapsed)
+	m.Set("rsp_collapsed_bytes", &s.rspCollapsedBytes)
+	m.Set("req_redirect_followed", &s.reqRedirectFollow)
+	m.Set("req_redirect_loop", &s.reqRedirectLoop)
+	m.Set("rsp_variant_incompressible", &s.rspIncompressible)
+	m.Set("purge_completed", &s.purgeDone)
+	m.Set("purge_queued", &s.purgeQueued)
+	m.Set("purge_deduplicated", &s.purgeDeduped)
+	m.Set("req_only_if_cached_miss", &s.reqCacheOnlyMiss)
+	m.Set("rsp_stale_overwrite_skipped", &s.rspStaleOverwrite)
+	m.Set("purge_cancelled_store", &s.purgeCancelStore)
+	m.Set("refresh_started", &s.reqRefreshStart)
+	m.Set("refresh_succeeded", &s.reqRefreshOK)
+	m.Set("refresh_failed", &s.reqRefreshFail)
+	m.Set("refresh_in_progress", &s.reqRefreshActive)
+	m.Set("refresh_duration_ms", &s.reqRefreshMillis)
+	m.Set("req_coalesce_too_large", &s.reqCoalesceLarge)
+	m.Set("mem_idle_evicted", &s.memIdleEvict)
+	m.Set("hot_keys", expvar.Func(func() any { return s.HotKeys() }))
+	m.Set("pinned_keys", expvar.Func(func() any { return s.PinnedKeys() }))
+	m.Set("pinned_bytes", expvar.Func(func() any { return s.pinnedBytes() }))
 	return m
 }
 
@@ -188,58 +1095,420 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash := hashRequestURL(r.URL)
+	if s.TransformResponseHeaders != nil {
+		w = &headerHookWriter{ResponseWriter: w, hook: s.TransformResponseHeaders}
+	}
+	if len(s.CORSOrigins) != 0 {
+		req := r
+		w = &headerHookWriter{ResponseWriter: w, hook: func(h http.Header) { s.setAllowOrigin(req, h) }}
+	}
+	r = s.bufferKeyBody(r)
+	hash := s.hashRequest(r)
 	canCache := s.canCacheRequest(r)
 	s.vlogf("rp B U:%q H:%s C:%v", r.URL, hash, canCache)
+	if canCache && s.SequentialPrefetch != nil {
+		defer s.prefetchNext(r)
+	}
 	start := time.Now()
+	s.checkMemoryPressure(start)
+	if s.TraceRequests != nil && s.TraceRequests(r) {
+		var tr *decisionTrace
+		r, tr = withTrace(r, hash, start)
+		w = &headerHookWriter{ResponseWriter: w, hook: tr.setHeader}
+		tr.addf("request", time.Time{}, "can cache: %v", canCache)
+		defer func() { s.logf("trace %s %s", r.URL, tr.encode()) }()
+	}
+
+	// If we find a cached copy that is not fresh enough to serve, keep track of
+	// it so that we can compare it to the response from the origin.
+	var stale *memCacheEntry
+	readOnly := r.Header.Get(s.readOnlyHeader()) != ""
 	if canCache {
-		// Check for a hit on this object in the memory cache.
-		if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
+		// N.B. A read-only request can't refresh a hot key in the background,
+		// so it doesn't get stale hits either.
+		isHot := s.recordKey(hash, start) && !readOnly
+		if len(s.PrecomputeVariants) != 0 && s.serveVariant(w, r, hash, start) {
+			return
+		}
+		var ok bool
+		if stale, ok = s.serveCached(w, r, hash, isHot, start); ok {
+			return
+		}
+
+		// If another request is already fetching this object, wait for it to
+		// finish and check the cache again, rather than fetching it ourselves.
+		// A read-only request will not update the cache, so it does not lead.
+		if !readOnly {
+			t0 := time.Now()
+			lead, leaderDone := s.joinFlight(r.Context(), hash)
+			if lead != nil {
+				defer s.endFlight(hash, lead)
+				r = withFlight(r, lead)
+			} else if leaderDone {
+				traceOf(r).add("coalesce", "waited for fetch", t0)
+				if stale, ok = s.serveCached(w, r, hash, isHot, start); ok {
+					return
+				}
+			}
+		}
+	}
+
+	// A request that may only be served from the cache stops here.
+	if isOnlyIfCached(r) {
+		s.serveOnlyIfCachedMiss(w, r, hash)
+		return
+	}
+
+	// If the origin is failing, don't add to its load; serve what we have.
+	if ok, wait := s.originAvailable(start); !ok {
+		s.serveDegraded(w, r, hash, stale, wait, start)
+		return
+	}
+
+	// Reaching here, the object is not already cached locally so we have to
+	// talk to the backend to get it. We need to do this whether or not it is
+	// cacheable.
+	s.forward(w, r, hash, canCache && !readOnly, stale, start)
+}
+
+// serveCached attempts to serve r from the cache, and reports whether it did.
+// If not, it returns a cached copy of the object, if one was found, that was
+// not fresh enough to serve. The isHot flag reports whether hash is a hot key.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, hash string, isHot bool, start time.Time) (stale *memCacheEntry, ok bool) {
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	tiers := s.maxTiers(r)
+	tr := traceOf(r)
+	miss := func() (*memCacheEntry, bool) {
+		s.reqTierSkip.Add(1)
+		tr.addf("tiers", time.Time{}, "stopped after %d", tiers)
+		s.vlogf("rp - H:%s miss (%d tiers)", hash, tiers)
+		return stale, false
+	}
+
+	// Check for a hit on this object in the memory cache.
+	t0 := time.Now()
+	if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
+		fresh := isFresh(hdr, start)
+		serve, keep := s.checkFreshness(r, reqCC, hdr, start)
+		if serve {
+			tr.add("memory", "hit", t0)
 			s.reqMemoryHit.Add(1)
+			s.refreshEarly(r, hash, hdr, start)
 			setXCacheInfo(hdr, "hit, memory", hash)
-			writeCachedResponse(w, hdr, data)
+			s.writeCachedResponse(w, r, hdr, data)
 			s.vlogf("rp E H:%s hit mem B:%d (%v elapsed)", hash, len(data), time.Since(start))
-			return
+			return nil, true
+		} else if keep && !fresh && isHot && !reqCC.Keys.Has("min-fresh") {
+			// This is a hot key whose entry has expired but is still
+			// within its grace period: Serve the stale entry, and refresh
+			// it in the background.
+			tr.add("memory", "hit, stale (hot key)", t0)
+			s.reqMemoryStale.Add(1)
+			s.refreshAsync(r, hash)
+			setXCacheInfo(hdr, "hit, memory, stale", hash)
+			hdr.Add("Warning", warnStale)
+			s.writeCachedResponse(w, r, hdr, data)
+			s.vlogf("rp E H:%s hit mem stale B:%d (%v elapsed)", hash, len(data), time.Since(start))
+			return nil, true
 		}
+		tr.add("memory", traceFreshness(fresh), t0)
+		if keep {
+			stale = &memCacheEntry{header: hdr, body: data}
+		}
+	} else if errors.Is(err, errHeaderOnly) {
+		// Only the header of the object was retained. Revalidate it with
+		// the origin, and read the body from the other tiers only if it has
+		// not been modified.
+		tr.add("memory", "header only", t0)
+		if _, keep := s.checkFreshness(r, reqCC, hdr, start); keep && canRevalidate(r, hdr) {
+			s.vlogf("rp - H:%s miss, header only", hash)
+			return &memCacheEntry{header: hdr, stub: true}, false
+		}
+	} else {
+		tr.add("memory", traceMiss(err), t0)
+	}
+	if tiers < tierLocal {
+		return miss()
+	}
 
-		// Check for a hit on this object in the local cache.
-		if data, hdr, err := s.cacheLoadLocal(hash); err == nil {
-			s.reqLocalHit.Add(1)
-			setXCacheInfo(hdr, "hit, local", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
-			return
+	// Check for a hit on this object in the local cache.
+	t0 = time.Now()
+	var comparedS3 bool
+	if data, hdr, err := s.cacheLoadLocal(hash); err == nil {
+		src := "local"
+		if s.PreferFreshestTier && tiers >= tierS3 {
+			data, hdr, src, comparedS3 = s.freshestCopy(r.Context(), hash, data, hdr, start)
+		}
+		fresh := isFresh(hdr, start)
+		serve, keep := s.checkFreshness(r, reqCC, hdr, start)
+		if serve {
+			tr.add(src, "hit", t0)
+			if src == "remote" {
+				s.reqFaultHit.Add(1)
+			} else {
+				s.reqLocalHit.Add(1)
+			}
+			s.refreshEarly(r, hash, hdr, start)
+			setXCacheInfo(hdr, "hit, "+src, hash)
+			s.writeCachedResponse(w, r, hdr, data)
+			s.vlogf("rp E H:%s hit %s B:%d (%v elapsed)", hash, src, len(data), time.Since(start))
+			return nil, true
+		}
+		tr.add(src, traceFreshness(fresh), t0)
+		if keep {
+			stale = &memCacheEntry{header: hdr, body: data}
 		}
-		s.reqLocalMiss.Add(1)
+	} else {
+		tr.add("local", traceMiss(err), t0)
+	}
+	s.reqLocalMiss.Add(1)
+	if tiers < tierS3 {
+		return miss()
+	} else if comparedS3 {
+		// The S3 copy was already considered, and was not fresh enough.
+		s.reqFaultMiss.Add(1)
+		s.vlogf("rp - H:%s miss", hash)
+		return stale, false
+	}
 
-		// Fault in from S3.
-		if data, hdr, err := s.cacheLoadS3(r.Context(), hash); err == nil {
+	// Fault in from S3.
+	t0 = time.Now()
+	data, hdr, err := s.cacheLoadS3(r.Context(), hash)
+	if errors.Is(err, errDirectS3) && s.serveS3Direct(w, r, hash, reqCC, start) {
+		tr.add("remote", "hit, direct", t0)
+		return nil, true
+	} else if err == nil {
+		fresh := isFresh(hdr, start)
+		serve, keep := s.checkFreshness(r, reqCC, hdr, start)
+		if serve {
+			tr.add("remote", "hit", t0)
 			s.reqFaultHit.Add(1)
-			if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
+			s.refreshEarly(r, hash, hdr, start)
+			if err := s.cacheStoreLocal(hash, hdr, data); err != nil && !errors.Is(err, errDiskDisabled) {
 				s.logf("update %q local: %v", hash, err)
 			}
 			setXCacheInfo(hdr, "hit, remote", hash)
-			writeCachedResponse(w, hdr, data)
+			s.writeCachedResponse(w, r, hdr, data)
 			s.vlogf("rp E H:%s hit S3 B:%d (%v elapsed)", hash, len(data), time.Since(start))
-			return
+			return nil, true
 		}
-		s.reqFaultMiss.Add(1)
-		s.vlogf("rp - H:%s miss", hash)
+		tr.add("remote", traceFreshness(fresh), t0)
+		if stale == nil && keep {
+			stale = &memCacheEntry{header: hdr, body: data}
+		}
+	} else {
+		tr.add("remote", traceMiss(err), t0)
 	}
+	s.reqFaultMiss.Add(1)
+	s.vlogf("rp - H:%s miss", hash)
+	return stale, false
+}
 
-	// Reaching here, the object is not already cached locally so we have to
-	// talk to the backend to get it. We need to do this whether or not it is
-	// cacheable. Note we handle each request with its own proxy instance, so
-	// that we can handle each response in context of this request.
+// traceFreshness returns a trace result for a cached object that was found but
+// not served, given whether it was fresh.
+func traceFreshness(fresh bool) string {
+	if fresh {
+		return "not fresh enough for request"
+	}
+	return "stale"
+}
+
+// traceMiss returns a trace result for a cache lookup that failed with err.
+func traceMiss(err error) string {
+	if errors.Is(err, fs.ErrNotExist) || gcerrors.Code(err) == gcerrors.NotFound {
+		return "miss"
+	}
+	return "miss: " + err.Error()
+}
+
+// freshestCopy compares the local copy of the object for hash, with body data
+// and header hdr, to the copy in S3, and returns whichever is fresher as of
+// now, along with the name of its tier ("local" or "remote"). It also reports
+// whether the S3 copy was read. If the copies differ in freshness, the staler
+// one is replaced by the fresher in the background.
+func (s *Server) freshestCopy(ctx context.Context, hash string, data []byte, hdr http.Header, now time.Time) ([]byte, http.Header, string, bool) {
+	rdata, rhdr, err := s.cacheLoadS3(ctx, hash)
+	if err != nil {
+		return data, hdr, "local", false
+	}
+	switch {
+	case fresherThan(rhdr, hdr, now):
+		s.tierFreshRepair.Add(1)
+		s.logf("tiers %q: S3 copy is fresher than local; updating local", hash)
+		s.start(func() error {
+			if err := s.cacheStoreLocal(hash, rhdr, rdata); err != nil {
+				s.logf("update %q local: %v", hash, err)
+			}
+			return nil
+		})
+		return rdata, rhdr.Clone(), "remote", true
+	case fresherThan(hdr, rhdr, now):
+		s.tierFreshRepair.Add(1)
+		s.logf("tiers %q: local copy is fresher than S3; updating S3", hash)
+		s.start(s.cacheStoreS3(hash, hdr.Clone(), data))
+	}
+	return data, hdr, "local", true
+}
+
+// fresherThan reports whether a cached object with header a is fresher as of
+// now than one with header b: It remains fresh for longer, or if both remain
+// fresh for the same time, it was generated more recently. An object without
+// a bounded freshness lifetime is fresher than any with one.
+func fresherThan(a, b http.Header, now time.Time) bool {
+	ra, oka := freshnessRemaining(a, now)
+	rb, okb := freshnessRemaining(b, now)
+	if oka != okb {
+		return okb // unbounded is fresher
+	} else if oka && ra != rb {
+		return ra > rb
+	}
+	da, erra := http.ParseTime(a.Get("Date"))
+	db, errb := http.ParseTime(b.Get("Date"))
+	return erra == nil && (errb != nil || da.After(db))
+}
+
+// Cache tiers, in the order they are consulted.
+const (
+	tierMemory = 1 + iota
+	tierLocal
+	tierS3
+)
+
+// maxTiers returns the number of cache tiers to consult for r.
+func (s *Server) maxTiers(r *http.Request) int {
+	n := s.MaxTiersConsulted
+	if s.MaxTiersFunc != nil {
+		n = s.MaxTiersFunc(r)
+	}
+	if n <= 0 || n > tierS3 {
+		return tierS3
+	}
+	return n
+}
+
+// serveS3Direct attempts to serve r from the object for hash in S3, streaming
+// it to the client without storing it locally, and reports whether it did.
+func (s *Server) serveS3Direct(w http.ResponseWriter, r *http.Request, hash string, reqCC cacheControl, start time.Time) bool {
+	hdr, body, size, err := s.cacheOpenS3(r.Context(), hash)
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+	if serve, _ := s.checkFreshness(r, reqCC, hdr, start); !serve {
+		return false
+	}
+	s.reqFaultHit.Add(1)
+	s.reqS3Direct.Add(1)
+	setXCacheInfo(hdr, "hit, remote", hash)
+	hdr.Set("Content-Length", strconv.FormatInt(size, 10))
+	s.writeCachedResponseFrom(w, r, hdr, body)
+	s.vlogf("rp E H:%s hit S3 direct B:%d (%v elapsed)", hash, size, time.Since(start))
+	return true
+}
+
+// forward forwards r to the origin and writes the response to w, updating the
+// cache for hash if canCache is true and the response permits. If stale is not
+// nil, it is a cached copy of the object that was not fresh enough to serve.
+//
+// Note we handle each request with its own proxy instance, so that we can
+// handle each response in context of this request.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, hash string, canCache bool, stale *memCacheEntry, start time.Time) {
 	s.reqForward.Add(1)
-	proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
+	tr, sent := traceOf(r), time.Now()
+	target, err := s.upstreamURL(r)
+	if err != nil {
+		s.logf("forward %q: upstream URL: %v", r.URL, err)
+		tr.addf("origin", time.Time{}, "no upstream: %v", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite:   func(pr *httputil.ProxyRequest) { s.rewriteRequest(pr, target) },
+		Transport: s.originTransport(),
+	}
 	updateCache := func() {}
+
+	// Keep track of the fetch and the stores that follow, so that purges of
+	// the object can be ordered with them.
+	var tok *storeToken
+	if canCache && s.PurgeStoreOrdering != PurgeUnordered {
+		tok = s.stores.begin(hash)
+		defer tok.done()
+	}
+
+	// If we have a stale copy with validators, and the client did not send its
+	// own, ask the origin to revalidate our copy.
+	revalidate := canCache && stale != nil && canRevalidate(r, stale.header)
+	if revalidate {
+		proxy.Rewrite = func(pr *httputil.ProxyRequest) {
+			s.rewriteRequest(pr, target)
+			setValidators(pr.Out.Header, stale.header)
+		}
+	}
+	// If we have a stale copy that permits serving it when the origin fails,
+	// do so rather than reporting the error.
+	staleOnError := canCache && stale != nil && !stale.stub && canServeStaleOnError(stale.header, start)
+	var notModified bool
 	if canCache {
 		proxy.ModifyResponse = func(rsp *http.Response) error {
+			if revalidate && stale.stub && rsp.StatusCode == http.StatusNotModified && !s.loadStubBody(r, hash, stale) {
+				// The body of the object is no longer stored anywhere, so
+				// fetch the object again in full after all.
+				if err := s.fetchInFull(rsp); err != nil {
+					return err
+				}
+				revalidate, stale = false, nil
+			}
+
+			// A lifetime assigned by the cache is recorded with the stored
+			// copy of the response, but not sent to the client.
+			rsp.Header.Del(lifetimeHeader)
+			defer func() { rsp.Header.Del(lifetimeHeader) }()
+
+			s.sanitizeCacheControl(rsp.Header)
+			s.applyStatusTTL(rsp)
+
+			// Freshness and Age are computed from the Date of the response, so
+			// if the origin did not send one, use the time we received it
+			// (RFC 9110 Section 6.6.1).
+			if _, err := http.ParseTime(rsp.Header.Get("Date")); err != nil {
+				rsp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			}
+			s.applyHeuristicTTL(rsp)
+			if staleOnError && rsp.StatusCode >= 500 {
+				tr.add("store", "none, serving stale on error", time.Time{})
+				s.reqStaleOnError.Add(1)
+				rsp.Header = make(http.Header)
+				restoreStale(rsp, stale)
+				s.setAgeHeader(rsp.Header, time.Now())
+				rsp.Header.Add("Warning", warnStale)
+				rsp.Header.Add("Warning", warnRevalidationFailed)
+				setXCacheInfo(rsp.Header, "hit, stale", hash)
+				s.vlogf("rp E H:%s hit stale B:%d (%v elapsed)", hash, len(stale.body), time.Since(start))
+				return nil
+			}
+			if revalidate && rsp.StatusCode == http.StatusNotModified {
+				// Our stale copy is still good: Serve it with the updated
+				// headers from the origin, and refresh it in the cache.
+				notModified = true
+				s.rspRevalidated.Add(1)
+				restoreStale(rsp, stale)
+				s.applyStatusTTL(rsp)
+				s.applyHeuristicTTL(rsp)
+			}
+			s.abandonFlight(hash, flightOf(r), rsp)
 			maxAge, isVolatile := s.canMemoryCache(rsp)
 			canCacheResponse := s.canCacheResponse(rsp)
+
+			// If the origin did not send any validators, use the time of the
+			// fetch as the Last-Modified time.
+			synthLM := s.SynthesizeLastModified && rsp.StatusCode == http.StatusOK && !hasValidator(rsp.Header)
+			if synthLM {
+				rsp.Header.Set("Last-Modified", start.UTC().Format(http.TimeFormat))
+			}
 			if !canCacheResponse && !isVolatile {
 				// A response we cannot cache at all.
+				tr.add("store", "none", time.Time{})
 				setXCacheInfo(rsp.Header, "fetch, uncached", "")
 				s.rspNotCached.Add(1)
 				s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
@@ -248,55 +1517,387 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			// Read out the whole response body so we can update the cache, and
 			// replace the response reader so we can copy it back to the caller.
-			var buf bytes.Buffer
+			// Large bodies are spilled to a temporary file, which is removed
+			// once the object has been stored.
+			buf := newBodyBuffer(s.Local, s.SpillThreshold, s.checksumAlgorithm(rsp.Header, rsp.ContentLength))
+			lifetime := rsp.Header.Get(lifetimeHeader)
 			rsp.Body = copyReader{
-				Reader: io.TeeReader(rsp.Body, &buf),
+				Reader: io.TeeReader(rsp.Body, buf),
 				Closer: rsp.Body,
 			}
 			if !canCacheResponse && isVolatile {
 				// A volatile response we can cache temporarily.
+				tr.addf("store", time.Time{}, "memory (max-age %v)", maxAge)
 				setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash)
 				updateCache = func() {
-					body := buf.Bytes()
-					s.cacheStoreMemory(hash, maxAge, rsp.Header, body)
+					defer buf.Close()
+					body, err := buf.Bytes()
+					if err != nil {
+						s.rspSaveError.Add(1)
+						s.logf("save %q to memory: %v", hash, err)
+						return
+					}
+					if synthLM {
+						keepLastModified(rsp.Header, stale, buf)
+					}
+					hdr := withFetchTime(withStatus(rsp.Header, rsp.StatusCode), time.Since(sent))
+					if lifetime != "" {
+						hdr.Set(lifetimeHeader, lifetime)
+					}
+					if s.storeCancelled(tok, "memory") {
+						return
+					} else if isPreflight(r) {
+						s.cacheStoreMemory(hash, maxAge, preflightHeader(hdr, maxAge), body, corsHeaders...)
+					} else {
+						s.cacheStoreMemory(hash, maxAge, hdr, body)
+					}
 					s.rspSaveMem.Add(1)
 
 					// N.B. Don't persist on disk or in S3.
 					s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(body), time.Since(start))
 				}
 			} else {
+				tr.add("store", "local, remote", time.Time{})
 				setXCacheInfo(rsp.Header, "fetch, cached", hash)
+				if s.hasVariants(rsp.Header) {
+					addVary(rsp.Header, "Accept-Encoding") // see serveVariant
+				}
 				updateCache = func() {
-					body := buf.Bytes()
-					if err := s.cacheStoreLocal(hash, rsp.Header, body); err != nil {
+					if s.storeCancelled(tok, "local") {
+						buf.Close()
+						return
+					}
+					if synthLM {
+						keepLastModified(rsp.Header, stale, buf)
+					}
+					hdr := withFetchTime(withStatus(rsp.Header, rsp.StatusCode), time.Since(sent))
+					if lifetime != "" {
+						hdr.Set(lifetimeHeader, lifetime)
+					}
+
+					// If the stored object already has this content, we only
+					// need to refresh the header of the local copy.
+					same := notModified || s.sameContent(stale, rsp.Header, buf)
+					if same {
+						if err := s.cacheUpdateLocalHeader(hash, hdr, buf); err == nil {
+							if !notModified {
+								s.rspSame.Add(1)
+							}
+							buf.Close()
+							s.vlogf("rp E H:%s fetch RC:same B:%d (%v elapsed)", hash, buf.Len(), time.Since(start))
+							return
+						}
+					}
+
+					// If another variant of this URL has the same body, store
+					// a reference to it instead.
+					store := buf
+					if ref := s.collapseVariant(r, hash, buf); ref != "" {
+						hdr = hdr.Clone()
+						hdr.Set(bodyRefHeader, ref)
+						store = refBody(buf.Checksum())
+						defer buf.Close()
+					}
+
+					// If the local cache is disabled, store the object in S3 only.
+					if err := s.cacheStoreLocalFrom(hash, hdr, store); err != nil && !errors.Is(err, errDiskDisabled) {
 						s.rspSaveError.Add(1)
 						s.logf("save %q to cache: %v", hash, err)
+						buf.Close()
 
 						// N.B.: Don't bother trying to forward to S3 in this case.
 					} else {
+						// N.B.: An unchanged object with no local copy to refresh
+						// is uploaded again, to extend the lifetime in S3 too.
 						s.rspSave.Add(1)
-						s.rspSaveBytes.Add(int64(len(body)))
-						s.start(s.cacheStoreS3(hash, rsp.Header, body))
+						s.rspSaveBytes.Add(buf.Len())
+						tok.hold()
+						storeS3 := s.cacheStoreS3From(hash, hdr, store) // closes store
+						s.start(func() error {
+							defer tok.done()
+							if s.storeCancelled(tok, "S3") {
+								return store.Close()
+							}
+							return storeS3()
+						})
+						if len(s.PrecomputeVariants) != 0 {
+							tok.hold()
+							storeVariants := s.storeVariants(hash)
+							s.start(func() error {
+								defer tok.done()
+								if s.storeCancelled(tok, "variants") {
+									return nil
+								}
+								return storeVariants()
+							})
+						}
 					}
-					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(body), time.Since(start))
+					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, buf.Len(), time.Since(start))
+				}
+			}
+			if notModified {
+				setXCacheInfo(rsp.Header, "hit, revalidated", hash)
+			}
+			return nil
+		}
+	}
+	if s.NormalizeError != nil {
+		modify := proxy.ModifyResponse
+		proxy.ModifyResponse = func(rsp *http.Response) error {
+			s.normalizeError(rsp)
+			if modify != nil {
+				return modify(rsp)
+			}
+			return nil
+		}
+	}
+	if s.OriginErrorThreshold > 0 {
+		// Keep track of the health of the origin.
+		modify := proxy.ModifyResponse
+		proxy.ModifyResponse = func(rsp *http.Response) error {
+			s.recordOrigin(rsp.StatusCode >= 500, time.Now())
+			if modify != nil {
+				return modify(rsp)
+			}
+			return nil
+		}
+	}
+	if tr != nil {
+		modify := proxy.ModifyResponse
+		proxy.ModifyResponse = func(rsp *http.Response) error {
+			tr.addf("origin", sent, "%d", rsp.StatusCode)
+			if modify != nil {
+				return modify(rsp)
+			}
+			return nil
+		}
+	}
+	if !r.ProtoAtLeast(1, 1) {
+		// An HTTP/1.0 client cannot receive a chunked response, so give one
+		// of unknown length a Content-Length, after it has been processed.
+		modify := proxy.ModifyResponse
+		proxy.ModifyResponse = func(rsp *http.Response) error {
+			if modify != nil {
+				if err := modify(rsp); err != nil {
+					return err
 				}
 			}
+			if needsLength(r, rsp) {
+				return s.bufferLength(rsp)
+			}
 			return nil
 		}
 	}
+	if s.EarlyHints {
+		rewrite := proxy.Rewrite
+		proxy.Rewrite = func(pr *httputil.ProxyRequest) {
+			rewrite(pr)
+			s.watchEarlyHints(pr)
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		tr.addf("origin", sent, "error: %v", err)
+		if r.Context().Err() == nil {
+			s.recordOrigin(true, time.Now()) // not the client giving up
+		}
+		s.logf("forward %q: %v", r.URL, err)
+		if staleOnError {
+			s.reqStaleOnError.Add(1)
+			stale.header.Add("Warning", warnStale)
+			stale.header.Add("Warning", warnRevalidationFailed)
+			setXCacheInfo(stale.header, "hit, stale", hash)
+			s.writeCachedResponse(w, r, stale.header, stale.body)
+			s.vlogf("rp E H:%s hit stale B:%d (%v elapsed)", hash, len(stale.body), time.Since(start))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
 	proxy.ServeHTTP(w, r)
 	updateCache()
 }
 
-// rewriteRequest rewrites the inbound request for routing to a target.
-func (s *Server) rewriteRequest(pr *httputil.ProxyRequest) {
-	u, _ := url.ParseRequestURI(pr.In.RequestURI)
-	u.Host = pr.In.Host
+// sameContent reports whether content hash revalidation is enabled, and the
+// stale cached object has the same content as a response with the given
+// header and body. It reports false if the response has an ETag,
+// since in that case the origin is responsible for validation.
+func (s *Server) sameContent(stale *memCacheEntry, hdr http.Header, body *bodyBuffer) bool {
+	if !s.ContentHashRevalidation || stale == nil || hdr.Get("Etag") != "" {
+		return false
+	}
+	return bodyChecksum(stale.header, stale.body, body.algo) == body.Checksum()
+}
+
+// canServeStaleOnError reports whether a stale cached object with header hdr
+// may be served at time now in place of an error from the origin, as
+// permitted by its stale-if-error directive (RFC 5861 Section 4).
+func canServeStaleOnError(hdr http.Header, now time.Time) bool {
+	cc := parseCacheControl(hdr.Get("Cache-Control"))
+	if cc.StaleIfError <= 0 {
+		return false
+	}
+	rem, ok := freshnessRemaining(hdr, now)
+	return ok && -rem <= cc.StaleIfError
+}
+
+// canRevalidate reports whether a stale cached object with header hdr can be
+// revalidated with the origin on behalf of r. This requires that the object
+// have a validator, and that r does not carry validators of its own.
+func canRevalidate(r *http.Request, hdr http.Header) bool {
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	return hasValidator(hdr)
+}
+
+// hasValidator reports whether hdr contains a validator (ETag or
+// Last-Modified) that can be used in a conditional request.
+func hasValidator(hdr http.Header) bool {
+	return hdr.Get("Etag") != "" || hdr.Get("Last-Modified") != ""
+}
+
+// keepLastModified sets the Last-Modified header of h to that of the stale
+// object, if there is one and it has the same body as body. This keeps a
+// synthesized Last-Modified time stable across refreshes of an object whose
+// content has not changed.
+func keepLastModified(h http.Header, stale *memCacheEntry, body *bodyBuffer) {
+	if stale == nil {
+		return
+	}
+	if lm := stale.header.Get("Last-Modified"); lm != "" && bodyChecksum(stale.header, stale.body, body.algo) == body.Checksum() {
+		h.Set("Last-Modified", lm)
+	}
+}
+
+// setValidators sets the conditional request headers on h corresponding to the
+// validators of a cached object with header obj.
+func setValidators(h, obj http.Header) {
+	if etag := obj.Get("Etag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lm := obj.Get("Last-Modified"); lm != "" {
+		h.Set("If-Modified-Since", lm)
+	}
+}
+
+// loadStubBody reads the body of the object whose header is retained by the
+// stub stale, from the local cache or S3, and reports whether it was found.
+// A copy with different validators than the stub is not used.
+func (s *Server) loadStubBody(r *http.Request, hash string, stale *memCacheEntry) bool {
+	body, hdr, err := s.cacheLoadLocal(hash)
+	if (err != nil || !sameValidators(hdr, stale.header)) && s.maxTiers(r) >= tierS3 {
+		body, hdr, err = s.cacheLoadS3(r.Context(), hash)
+	}
+	if err != nil || !sameValidators(hdr, stale.header) {
+		return false
+	}
+	stale.body = body
+	return true
+}
+
+// sameValidators reports whether the headers a and b have the same validators.
+func sameValidators(a, b http.Header) bool {
+	return a.Get("Etag") == b.Get("Etag") && a.Get("Last-Modified") == b.Get("Last-Modified")
+}
+
+// fetchInFull replaces the 304 (Not Modified) response rsp to a conditional
+// request with the response to the same request without its validators.
+func (s *Server) fetchInFull(rsp *http.Response) error {
+	req := rsp.Request.Clone(rsp.Request.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	rt := s.originTransport()
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	full, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	*rsp = *full
+	return nil
+}
+
+// restoreStale replaces the contents of a 304 (Not Modified) response rsp with
+// the stored object from stale, updated with the headers of rsp as described
+// in RFC 7234 Section 4.3.4.
+func restoreStale(rsp *http.Response, stale *memCacheEntry) {
+	rsp.Body.Close()
+	h := stale.header.Clone()
+	for name, vals := range rsp.Header {
+		h[name] = vals
+	}
+	h.Set("Content-Length", strconv.Itoa(len(stale.body)))
+	for name := range h {
+		if internalHeader(name) {
+			h.Del(name)
+		}
+	}
+	rsp.Header = h
+	rsp.StatusCode = cachedStatus(stale.header)
+	rsp.Status = http.StatusText(rsp.StatusCode)
+	rsp.ContentLength = int64(len(stale.body))
+	rsp.Body = io.NopCloser(bytes.NewReader(stale.body))
+}
+
+// normalizeError replaces rsp in place with the result of NormalizeError, if
+// rsp has an error status and NormalizeError returns a replacement.
+func (s *Server) normalizeError(rsp *http.Response) {
+	if rsp.StatusCode < 400 {
+		return
+	}
+	nr := s.NormalizeError(rsp)
+	if nr == nil || nr == rsp {
+		return
+	}
+	if nr.Header == nil {
+		nr.Header = make(http.Header)
+	}
+	if nr.Body != rsp.Body {
+		rsp.Body.Close()
+		if nr.Body == nil {
+			nr.Body = http.NoBody
+		}
+
+		// The length of the original body does not apply to the replacement.
+		nr.Header.Del("Content-Length")
+		if nr.ContentLength > 0 {
+			nr.Header.Set("Content-Length", strconv.FormatInt(nr.ContentLength, 10))
+		} else {
+			nr.ContentLength = -1
+		}
+	}
+	if nr.Status == "" || nr.StatusCode != rsp.StatusCode {
+		nr.Status = fmt.Sprintf("%d %s", nr.StatusCode, http.StatusText(nr.StatusCode))
+	}
+	nr.Request = rsp.Request
+	*rsp = *nr
+}
+
+// upstreamURL returns the URL to which r is forwarded. By default, this is
+// the URL of the request itself, using HTTPS if the request does not specify
+// a scheme.
+func (s *Server) upstreamURL(r *http.Request) (*url.URL, error) {
+	if s.UpstreamURL != nil {
+		return s.UpstreamURL(r)
+	}
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+	u.Host = r.Host
 	if u.Scheme == "" {
 		u.Scheme = "https"
 	}
-	pr.Out.URL = u
+	return u, nil
+}
+
+// rewriteRequest rewrites the inbound request for routing to target.
+func (s *Server) rewriteRequest(pr *httputil.ProxyRequest, target *url.URL) {
+	u := *target
+	pr.Out.URL = &u
 	pr.Out.Host = u.Host
+	pr.Out.Header.Del(s.readOnlyHeader())
 }
 
 type copyReader struct {
@@ -304,12 +1905,64 @@ type copyReader struct {
 	io.Closer
 }
 
+// headerHookWriter is a [http.ResponseWriter] that calls hook with the
+// response headers just before they are written. Informational (1xx) headers
+// do not trigger the hook.
+type headerHookWriter struct {
+	http.ResponseWriter
+	hook  func(http.Header)
+	wrote bool
+}
+
+func (w *headerHookWriter) WriteHeader(code int) {
+	if !w.wrote && code >= http.StatusOK {
+		w.wrote = true
+		w.hook(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerHookWriter) Write(data []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap supports [http.ResponseController].
+func (w *headerHookWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
 // makePath returns the local cache path for the specified request hash.
 func (s *Server) makePath(hash string) string { return filepath.Join(s.Local, hash[:2], hash) }
 
+// bucket returns the bucket where the object for the specified request hash
+// is stored.
+func (s *Server) bucket(hash string) *blob.Bucket {
+	if len(s.S3Buckets) == 0 {
+		return s.Bucket
+	}
+	var best uint64
+	var out *blob.Bucket
+	for i, b := range s.S3Buckets {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d:%s", i, hash)
+		if w := h.Sum64(); out == nil || w > best {
+			best, out = w, b
+		}
+	}
+	return out
+}
+
 // makeKey returns the S3 object key for the specified request hash.
 func (s *Server) makeKey(hash string) string { return path.Join(s.KeyPrefix, hash[:2], hash) }
 
+func (s *Server) readOnlyHeader() string {
+	if s.ReadOnlyHeader != "" {
+		return s.ReadOnlyHeader
+	}
+	return defaultReadOnlyHeader
+}
+
 func (s *Server) logf(msg string, args ...any) {
 	if s.Logf != nil {
 		s.Logf(msg, args...)
@@ -328,12 +1981,20 @@ func hostMatchesTarget(host string, targets []string) bool {
 
 // canCacheRequest reports whether r is a request whose response can be cached.
 func (s *Server) canCacheRequest(r *http.Request) bool {
-	return r.Method == "GET" && !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
+	if r.Method != "GET" && !(s.CacheOptionsRequests && isPreflight(r)) && keyBody(r) == "" {
+		return false
+	}
+	for _, name := range s.BypassOnCookies {
+		if _, err := r.Cookie(name); err == nil {
+			return false
+		}
+	}
+	return !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
 }
 
 // canCacheResponse reports whether r is a response whose body can be cached.
 func (s *Server) canCacheResponse(rsp *http.Response) bool {
-	if rsp.StatusCode != http.StatusOK {
+	if !s.canCacheResponseStatus(rsp) || isPreflight(rsp.Request) {
 		return false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
@@ -344,65 +2005,583 @@ func (s *Server) canCacheResponse(rsp *http.Response) bool {
 	}
 
 	// We treat a response that is not immutable but requires validation as
-	// cacheable if its max-age is so long it doesn't matter.
+	// cacheable if its lifetime is so long it doesn't matter.
 	const goodLongTime = 60 * 24 * time.Hour
-	return cc.Keys.Has("must-revalidate") && cc.MaxAge > goodLongTime
+	lt, _ := cc.lifetime(rsp.Header)
+	return cc.Keys.Has("must-revalidate") && lt > goodLongTime
 }
 
 type cacheControl struct {
-	Keys   mapset.Set[string]
-	MaxAge time.Duration
+	Keys     mapset.Set[string]
+	MaxAge   time.Duration
+	MinFresh time.Duration // request only
+
+	SMaxAge      time.Duration // response only
+	StaleIfError time.Duration // response only
+
+	// Malformed reports whether the header had invalid, negative, or
+	// conflicting numeric directives.
+	Malformed bool
+}
+
+// seconds returns the value of the numeric directive key, and reports whether
+// key is a numeric directive present in cc.
+func (cc cacheControl) seconds(key string) (time.Duration, bool) {
+	if !cc.Keys.Has(key) {
+		return 0, false
+	}
+	switch key {
+	case "max-age":
+		return cc.MaxAge, true
+	case "min-fresh":
+		return cc.MinFresh, true
+	case "s-maxage":
+		return cc.SMaxAge, true
+	case "stale-if-error":
+		return cc.StaleIfError, true
+	}
+	return 0, false
+}
+
+// lifetime returns the freshness lifetime, for a shared cache, of a response
+// with Cache-Control cc and header hdr, per RFC 9111 Section 4.2.1: Its
+// s-maxage if present, otherwise its max-age, otherwise the time from its Date
+// to its Expires. Failing those, it is the lifetime assigned by the cache and
+// recorded in lifetimeHeader, if any. It reports false if the response does
+// not specify one.
+//
+// An invalid Expires, or one without a valid Date, gives a lifetime of 0.
+func (cc cacheControl) lifetime(hdr http.Header) (time.Duration, bool) {
+	if cc.Keys.Has("s-maxage") {
+		return cc.SMaxAge, true
+	} else if cc.Keys.Has("max-age") {
+		return cc.MaxAge, true
+	} else if len(hdr.Values("Expires")) == 0 {
+		if n, err := strconv.ParseInt(hdr.Get(lifetimeHeader), 10, 64); err == nil && n >= 0 {
+			return time.Duration(n) * time.Second, true
+		}
+		return 0, false
+	}
+	exp, err := http.ParseTime(hdr.Get("Expires"))
+	if err != nil {
+		return 0, true
+	}
+	date, err := http.ParseTime(hdr.Get("Date"))
+	if err != nil {
+		return 0, true
+	}
+	return max(exp.Sub(date), 0), true
+}
+
+// freshnessLifetime returns the freshness lifetime of a response with header
+// hdr, as described by [cacheControl.lifetime].
+func freshnessLifetime(hdr http.Header) (time.Duration, bool) {
+	return parseCacheControl(hdr.Get("Cache-Control")).lifetime(hdr)
+}
+
+// canCacheStatus reports whether a response with the given status code may be
+// cached.
+func (s *Server) canCacheStatus(code int) bool {
+	return code == http.StatusOK || (code == http.StatusNoContent && s.CacheNoContent) ||
+		(isRedirect(code) && code != http.StatusSeeOther && s.FollowRedirects <= 0) ||
+		s.statusTTL(code) > 0
+}
+
+// canCacheResponseStatus reports whether rsp has a status that permits it to
+// be cached. A partial response may be cached only as a fragment, when the
+// request was for a single range and CachePartialContent is enabled.
+func (s *Server) canCacheResponseStatus(rsp *http.Response) bool {
+	if rsp.StatusCode == http.StatusPartialContent || rsp.Header.Get("Content-Range") != "" {
+		return s.CachePartialContent && rsp.StatusCode == http.StatusPartialContent &&
+			rsp.Request != nil && rangeKey(rsp.Request.Header) != "" && isConsistentFragment(rsp)
+	}
+	return s.canCacheStatus(rsp.StatusCode)
+}
+
+// rangeKey returns a normalized form of the Range header in h for use in a
+// cache key, or "" if h does not request a single byte range.
+func rangeKey(h http.Header) string {
+	v := strings.ToLower(strings.Join(strings.Fields(h.Get("Range")), ""))
+	spec, ok := strings.CutPrefix(v, "bytes=")
+	if !ok || spec == "" || strings.Contains(spec, ",") {
+		return ""
+	}
+	return "bytes=" + spec
+}
+
+// statusTTL returns the default lifetime configured by StatusClassTTL for a
+// response with the given status code, or 0 if there is none.
+func (s *Server) statusTTL(code int) time.Duration {
+	switch code {
+	case http.StatusPartialContent, http.StatusNotModified:
+		return 0 // not a complete response
+	}
+	return s.StatusClassTTL[code/100]
+}
+
+// applyStatusTTL gives a response rsp without an explicit freshness lifetime
+// the default lifetime for its status class, if any, by recording it in
+// lifetimeHeader. As for applyHeuristicTTL, the Cache-Control header is not
+// changed.
+func (s *Server) applyStatusTTL(rsp *http.Response) {
+	ttl := s.statusTTL(rsp.StatusCode)
+	if ttl <= 0 {
+		return
+	} else if _, ok := freshnessLifetime(rsp.Header); ok {
+		return
+	}
+	rsp.Header.Set(lifetimeHeader, strconv.FormatInt(int64(ttl/time.Second), 10))
 }
 
+// defaultHeuristicFraction is the default fraction of the time since an object
+// was last modified for which it is heuristically fresh.
+const defaultHeuristicFraction = 0.1
+
+// applyHeuristicTTL gives a response rsp without an explicit freshness
+// lifetime a heuristic one, if enabled by HeuristicFreshnessMax, by recording
+// it in lifetimeHeader. The Cache-Control header is not changed, so clients
+// do not take the heuristic for the origin's own lifetime.
+func (s *Server) applyHeuristicTTL(rsp *http.Response) {
+	if s.HeuristicFreshnessMax <= 0 {
+		return
+	}
+	frac := s.HeuristicFreshnessFraction
+	if frac <= 0 {
+		frac = defaultHeuristicFraction
+	}
+	lt, ok := heuristicLifetime(rsp.Header, frac, s.HeuristicFreshnessMax)
+	if !ok {
+		return
+	}
+	rsp.Header.Set(lifetimeHeader, strconv.FormatInt(int64(lt/time.Second), 10))
+}
+
+// heuristicLifetime returns the heuristic freshness lifetime of a response
+// with header hdr: frac of the time from its Last-Modified to its Date, at
+// most limit. It reports false if the response has an explicit lifetime, the
+// no-store or no-cache directive, or no valid Last-Modified and Date.
+func heuristicLifetime(hdr http.Header, frac float64, limit time.Duration) (time.Duration, bool) {
+	cc := parseCacheControl(hdr.Get("Cache-Control"))
+	if cc.Keys.Has("no-store") || cc.Keys.Has("no-cache") {
+		return 0, false
+	} else if _, ok := cc.lifetime(hdr); ok {
+		return 0, false
+	}
+	mod, err := http.ParseTime(hdr.Get("Last-Modified"))
+	if err != nil {
+		return 0, false
+	}
+	date, err := http.ParseTime(hdr.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	lt := time.Duration(frac * float64(max(date.Sub(mod), 0)))
+	return min(lt, limit), true
+}
+
+// parseCacheControl parses the directives of a Cache-Control header.
+//
+// Malformed numeric directives are handled leniently, rather than reported:
+// A directive whose value is missing or not a number is ignored, a negative
+// value is treated as 0, and if a directive is repeated with different values,
+// the most restrictive value is used. In each case, Malformed is set.
 func parseCacheControl(s string) (out cacheControl) {
 	for _, v := range strings.Split(s, ",") {
-		key, val, ok := strings.Cut(strings.TrimSpace(v), "=")
-		if ok && key == "max-age" {
-			sec, err := strconv.Atoi(val)
-			if err == nil {
-				out.MaxAge = time.Duration(sec) * time.Second
+		key, val, hasVal := strings.Cut(strings.TrimSpace(v), "=")
+		key = strings.ToLower(key)
+
+		// For response directives, the shortest lifetime is the most
+		// restrictive; for min-fresh, it is the longest.
+		var dst *time.Duration
+		switch key {
+		case "max-age":
+			dst = &out.MaxAge
+		case "min-fresh":
+			dst = &out.MinFresh
+		case "s-maxage":
+			dst = &out.SMaxAge
+		case "stale-if-error":
+			dst = &out.StaleIfError
+		}
+		if dst != nil {
+			d, ok := parseDelta(val)
+			if !hasVal || !ok {
+				out.Malformed = true
+				continue
+			} else if d < 0 {
+				out.Malformed = true
+				d = 0
+			}
+			if out.Keys.Has(key) {
+				out.Malformed = out.Malformed || d != *dst
+				if key == "min-fresh" {
+					d = max(*dst, d)
+				} else {
+					d = min(*dst, d)
+				}
 			}
+			*dst = d
 		}
 		out.Keys.Add(key)
 	}
 	return
 }
 
+// maxDeltaSeconds is the largest delta-seconds value we represent. Larger
+// values are treated as this value, per RFC 9111 Section 1.2.2.
+const maxDeltaSeconds = 1 << 31
+
+// parseDelta parses s as a possibly-quoted decimal number of seconds, and
+// reports whether it is valid.
+func parseDelta(s string) (time.Duration, bool) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		sec, err = maxDeltaSeconds, nil
+		if strings.HasPrefix(s, "-") {
+			sec = -1
+		}
+	}
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(min(sec, maxDeltaSeconds)) * time.Second, true
+}
+
+// sanitizeCacheControl replaces a malformed Cache-Control header in h with a
+// well-formed header having the same meaning, as interpreted by
+// parseCacheControl, so that the response is handled consistently wherever it
+// is later parsed. Multiple Cache-Control lines are combined. If a max-age was
+// given but could not be used, DefaultMaxAge is used in its place.
+//
+// The first malformed header seen is logged; later ones are only counted.
+func (s *Server) sanitizeCacheControl(h http.Header) {
+	vals := h.Values("Cache-Control")
+	v := strings.Join(vals, ", ")
+	cc := parseCacheControl(v)
+	if !cc.Malformed && len(vals) <= 1 {
+		return
+	}
+	if cc.Malformed {
+		s.rspMalformedCC.Add(1)
+		if s.loggedMalformedCC.CompareAndSwap(false, true) {
+			s.logf("malformed Cache-Control %q (further reports suppressed)", v)
+		}
+	}
+
+	var parts []string
+	var seen mapset.Set[string]
+	var droppedMaxAge bool
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		key, _, _ := strings.Cut(p, "=")
+		key = strings.ToLower(key)
+		if key == "max-age" && !cc.Keys.Has(key) {
+			droppedMaxAge = true
+		}
+		if key == "" || !cc.Keys.Has(key) || seen.Has(key) {
+			continue
+		}
+		seen.Add(key)
+		if d, ok := cc.seconds(key); ok {
+			p = fmt.Sprintf("%s=%d", key, d/time.Second)
+		}
+		parts = append(parts, p)
+	}
+	if droppedMaxAge && s.DefaultMaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("max-age=%d", s.DefaultMaxAge/time.Second))
+	}
+	if len(parts) == 0 {
+		h.Del("Cache-Control")
+	} else {
+		h.Set("Cache-Control", strings.Join(parts, ", "))
+	}
+}
+
+// parseSeconds parses s as a decimal number of seconds. If s is not a valid
+// number, it returns fallback.
+func parseSeconds(s string, fallback time.Duration) time.Duration {
+	sec, err := strconv.Atoi(s)
+	if err != nil {
+		return fallback
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// freshnessRemaining reports how much longer a cached object with the given
+// headers will remain fresh as of now. It reports false if the object does not
+// have a bounded freshness lifetime. An object with a lifetime but no valid
+// Date is treated as having no freshness remaining.
+func freshnessRemaining(hdr http.Header, now time.Time) (time.Duration, bool) {
+	lt, ok := freshnessLifetime(hdr)
+	if !ok {
+		return 0, false
+	}
+	date, err := http.ParseTime(hdr.Get("Date"))
+	if err != nil {
+		return 0, true
+	}
+	return lt - now.Sub(date), true
+}
+
+// checkFreshness reports whether a cached object with header hdr may be
+// served for r, which has request directives cc, as of now. If not, it
+// reports whether the object should be kept to revalidate with the origin.
+// It consults FreshnessFunc, if set, and otherwise isFresh and isFreshEnough.
+func (s *Server) checkFreshness(r *http.Request, cc cacheControl, hdr http.Header, now time.Time) (serve, keep bool) {
+	if s.FreshnessFunc == nil {
+		if mustRevalidate(hdr) {
+			return false, true
+		}
+		return isFresh(hdr, now) && s.isFreshEnough(cc, hdr, now), true
+	}
+	date, _ := http.ParseTime(hdr.Get("Date"))
+	fresh, revalidate := s.FreshnessFunc(r, hdr.Clone(), date)
+	return fresh, !fresh && revalidate
+}
+
+// mustRevalidate reports whether a cached object with headers hdr has the
+// no-cache response directive, so that it must be revalidated with the origin
+// before every use, however fresh it is (RFC 9111 Section 5.2.2.4).
+func mustRevalidate(hdr http.Header) bool {
+	return parseCacheControl(hdr.Get("Cache-Control")).Keys.Has("no-cache")
+}
+
+// isFresh reports whether a cached object with headers hdr is fresh as of
+// now. An object without a bounded freshness lifetime is always fresh.
+func isFresh(hdr http.Header, now time.Time) bool {
+	rem, ok := freshnessRemaining(hdr, now)
+	return !ok || rem > 0
+}
+
+// isFreshEnough reports whether a cached object with headers hdr satisfies the
+// freshness requirements of the request directives in cc.
+//
+// An immutable object will not change while it is fresh, so unless
+// RevalidateImmutable is set, it is always fresh enough.
+func (s *Server) isFreshEnough(cc cacheControl, hdr http.Header, now time.Time) bool {
+	if !s.RevalidateImmutable && isImmutable(hdr) {
+		return true
+	}
+	if cc.MinFresh > 0 {
+		if rem, ok := freshnessRemaining(hdr, now); ok && rem < cc.MinFresh {
+			return false
+		}
+	}
+	return true
+}
+
+// isImmutable reports whether a cached object with headers hdr was marked
+// immutable by the origin (RFC 8246).
+func isImmutable(hdr http.Header) bool {
+	return parseCacheControl(hdr.Get("Cache-Control")).Keys.Has("immutable")
+}
+
 // canMemoryCache reports whether r is a volatile response whose body can be
 // cached temporarily, and if so returns the maxmimum length of time the cache
 // entry should be valid for.
 func (s *Server) canMemoryCache(rsp *http.Response) (time.Duration, bool) {
-	if rsp.StatusCode != http.StatusOK {
+	if isPreflight(rsp.Request) {
+		return canCachePreflight(rsp)
+	} else if !s.canCacheResponseStatus(rsp) {
 		return 0, false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
-	if cc.Keys.Has("no-store") || cc.Keys.Has("no-cache") {
+	if cc.Keys.Has("no-store") {
+		return 0, false
+	} else if cc.Keys.Has("no-cache") {
 		// While no-cache doesn't mean we can't cache it, it requires
-		// re-validation before reusing the response, so treat that as if it were
-		// no-store.
+		// re-validation before reusing the response, so unless StoreNoCache is
+		// set, treat that as if it were no-store. Revalidation requires a
+		// validator.
+		if s.StoreNoCache > 0 && hasValidator(rsp.Header) {
+			return s.StoreNoCache, true
+		}
 		return 0, false
 	}
 
 	// We'll cache things in memory if they aren't expected to last too long.
-	if cc.MaxAge > 0 && cc.MaxAge < time.Hour {
-		return cc.MaxAge, true
+	if lt, _ := cc.lifetime(rsp.Header); lt > 0 && lt < time.Hour {
+		return lt, true
 	}
 	return 0, false
 }
 
-// hashRequest generates the storage digest for the specified request URL.
+// hashRequest generates the storage digest for the specified request.  By
+// default this is the digest of the request URL, but other parts of the
+// request may also contribute depending on how s is configured.
+func (s *Server) hashRequest(r *http.Request) string {
+	u := s.keyURL(r.URL)
+	var extra []string
+	if s.KeySalt != "" {
+		extra = append(extra, "Salt: "+s.KeySalt)
+	}
+	if isPreflight(r) {
+		extra = append(extra, preflightKey(r)...)
+	}
+	if kb := keyBody(r); kb != "" {
+		extra = append(extra, "Body: "+kb)
+	}
+	if s.CachePartialContent {
+		if rk := rangeKey(r.Header); rk != "" {
+			extra = append(extra, "Range: "+rk)
+		}
+	}
+	if s.LanguageKeyDepth > 0 {
+		if lang := normalizeLanguage(r.Header.Get("Accept-Language"), s.LanguageKeyDepth); lang != "" {
+			extra = append(extra, "Accept-Language: "+lang)
+		}
+	}
+	if len(extra) == 0 {
+		return hashRequestURL(u)
+	}
+	key := u.String() + "\n" + strings.Join(extra, "\n")
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// hashRequestURL generates the storage digest for the specified request URL.
 func hashRequestURL(u *url.URL) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(u.String())))
 }
 
-// writeCachedResponse generates an HTTP response for a cached result using the
-// provided headers and body from the cache object.
-func writeCachedResponse(w http.ResponseWriter, hdr http.Header, body []byte) {
+// normalizeLanguage returns a normalized form of the Accept-Language header
+// value s for use in a cache key. The result is the most preferred language
+// tag, truncated to at most depth subtags, and converted to lower case.
+// Quality values are discarded. For example, with depth 2, both "en-US,en;q=0.9"
+// and "en-us" normalize to "en-us", and with depth 1, to "en".
+//
+// If s does not contain any acceptable language tags, or only the wildcard
+// "*", the result is "".
+func normalizeLanguage(s string, depth int) string {
+	var best string
+	bestQ := 0.0
+	for _, v := range strings.Split(s, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if qv, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(qv, 64)
+			if err != nil {
+				continue // malformed; ignore this tag
+			}
+			q = f
+		}
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	if parts := strings.Split(best, "-"); len(parts) > depth {
+		best = strings.Join(parts[:depth], "-")
+	}
+	return best
+}
+
+// writeCachedResponse generates an HTTP response to r for a cached result
+// using the provided headers and body from the cache object. If r is a
+// conditional request satisfied by the cached object, it writes a 304 (Not
+// Modified) response without a body.
+func (s *Server) writeCachedResponse(w http.ResponseWriter, r *http.Request, hdr http.Header, body []byte) {
+	if hdr.Get("Content-Length") == "" {
+		setContentLength(hdr, int64(len(body))) // stored by an older version
+	}
+	s.writeCachedResponseFrom(w, r, hdr, bytes.NewReader(body))
+}
+
+// writeCachedResponseFrom writes a response from the cache, as
+// writeCachedResponse, with the body read from body.
+func (s *Server) writeCachedResponseFrom(w http.ResponseWriter, r *http.Request, hdr http.Header, body io.Reader) {
+	removeHopByHopHeaders(hdr)
+	s.setAgeHeader(hdr, time.Now())
+	if !isNotModified(r, hdr) {
+		s.sendEarlyHints(w, r, hdr)
+	}
+	body = s.setAcceptRanges(r, hdr, body)
 	wh := w.Header()
 	for name, vals := range hdr {
+		if internalHeader(name) {
+			continue
+		}
 		for _, val := range vals {
 			wh.Add(name, val)
 		}
 	}
-	w.Write(body)
+	if isNotModified(r, hdr) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	} else if code := cachedStatus(hdr); code != http.StatusOK {
+		w.WriteHeader(code)
+	}
+	copyStream(w, body, make([]byte, s.streamChunkSize()))
+}
+
+// setAgeHeader sets the Age header of a cached response with header h, as of
+// now, subject to the MaxAgeHeader and OmitAgeHeaderAfter settings. The age
+// is computed from the Date header; if there is no valid Date, Age is not set.
+func (s *Server) setAgeHeader(h http.Header, now time.Time) {
+	h.Del("Age")
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return
+	}
+	age := max(now.Sub(date), 0)
+	if s.OmitAgeHeaderAfter > 0 && age > s.OmitAgeHeaderAfter {
+		return
+	} else if s.MaxAgeHeader > 0 && age > s.MaxAgeHeader {
+		age = s.MaxAgeHeader
+	}
+	h.Set("Age", strconv.Itoa(int(age/time.Second)))
+}
+
+// isNotModified reports whether r has an If-None-Match or If-Modified-Since
+// condition that is satisfied by a cached object with header hdr.
+//
+// Following RFC 7232 Section 3.3, If-Modified-Since is ignored when the
+// request also has If-None-Match.
+func isNotModified(r *http.Request, hdr http.Header) bool {
+	if inm := r.Header.Values("If-None-Match"); len(inm) != 0 {
+		return matchETag(inm, hdr.Get("Etag"))
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(hdr.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
+
+// matchETag reports whether any of the entity tags listed in the If-None-Match
+// header values inm matches etag, the ETag of a cached object. The wildcard
+// "*" matches any object. Following RFC 7232 Section 3.2, tags are compared
+// weakly, so "W/" prefixes are ignored. Parsing stops at the first malformed
+// entry.
+func matchETag(inm []string, etag string) bool {
+	want := strings.TrimPrefix(etag, "W/")
+	for _, v := range inm {
+		for v = strings.TrimLeft(v, " \t,"); v != ""; v = strings.TrimLeft(v, " \t,") {
+			if v[0] == '*' {
+				return true
+			}
+			v = strings.TrimPrefix(v, "W/")
+			if v == "" || v[0] != '"' {
+				break // malformed
+			}
+			end := strings.IndexByte(v[1:], '"')
+			if end < 0 {
+				break // malformed
+			}
+			if tag := v[:end+2]; want != "" && tag == want {
+				return true
+			}
+			v = v[end+2:]
+		}
+	}
+	return false
 }
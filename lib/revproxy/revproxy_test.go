@@ -0,0 +1,1407 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob/memblob"
+)
+
+// testOrigin is an origin server for tests that counts the requests it serves.
+type testOrigin struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+// newTestProxy starts an origin server running h, and returns a proxy that
+// targets it, with a temporary local cache and an in-memory bucket.
+func newTestProxy(t *testing.T, h http.HandlerFunc) (*Server, *testOrigin) {
+	t.Helper()
+
+	origin := new(testOrigin)
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin.requests.Add(1)
+		h(w, r)
+	}))
+	t.Cleanup(origin.Close)
+
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatalf("Parse origin URL: %v", err)
+	}
+	bucket := memblob.OpenBucket(nil)
+	t.Cleanup(func() { bucket.Close() })
+
+	s := &Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Bucket:  bucket,
+		Logf:    t.Logf,
+	}
+
+	// Wait for background tasks (e.g., S3 writes) before closing the bucket.
+	t.Cleanup(func() {
+		if s.tasks != nil {
+			s.tasks.Wait()
+		}
+	})
+	return s, origin
+}
+
+// get issues a GET request for path to s, with the given request headers
+// given as alternating name, value pairs.
+func (o *testOrigin) get(t *testing.T, s *Server, path string, hdrs ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", o.URL+path, nil)
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// hash returns the cache key for a request to path on the origin.
+func (o *testOrigin) hash(t *testing.T, path string) string {
+	t.Helper()
+	u, err := url.Parse(o.URL + path)
+	if err != nil {
+		t.Fatalf("Parse URL: %v", err)
+	}
+	return hashRequestURL(u)
+}
+
+func TestMinFresh(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	if rsp := origin.get(t, s, "/a"); rsp.Header().Get("X-Cache") != "fetch, cached, volatile" {
+		t.Fatalf("First request: got X-Cache %q", rsp.Header().Get("X-Cache"))
+	}
+
+	// With no request directives, we should get a hit.
+	if rsp := origin.get(t, s, "/a"); rsp.Header().Get("X-Cache") != "hit, memory" {
+		t.Errorf("Second request: got X-Cache %q, want hit", rsp.Header().Get("X-Cache"))
+	}
+	if got := origin.requests.Load(); got != 1 {
+		t.Errorf("Origin requests: got %d, want 1", got)
+	}
+
+	// The object will expire within 60 seconds, so min-fresh=120 cannot be
+	// satisfied from the cache.
+	rsp := origin.get(t, s, "/a", "Cache-Control", "min-fresh=120")
+	if got := rsp.Header().Get("X-Cache"); got == "hit, memory" {
+		t.Errorf("Got X-Cache %q, want a fetch", got)
+	}
+	if got := origin.requests.Load(); got != 2 {
+		t.Errorf("Origin requests: got %d, want 2", got)
+	}
+	if got := rsp.Body.String(); got != "hello" {
+		t.Errorf("Body: got %q, want hello", got)
+	}
+
+	// A min-fresh that fits within the remaining lifetime is a hit.
+	if rsp := origin.get(t, s, "/a", "Cache-Control", "min-fresh=10"); rsp.Header().Get("X-Cache") != "hit, memory" {
+		t.Errorf("Got X-Cache %q, want hit", rsp.Header().Get("X-Cache"))
+	}
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if r.URL.Path == "/immutable" {
+			h.Set("Cache-Control", "max-age=3600, immutable")
+		} else {
+			h.Set("Cache-Control", "max-age=60")
+		}
+		h.Set("Connection", "X-Hop")
+		h.Set("X-Hop", "bunny")
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("Etag", `"abc"`)
+		w.Write([]byte("content"))
+	})
+	checkHeader := func(where string, h http.Header) {
+		t.Helper()
+		for _, name := range []string{"Connection", "X-Hop", "Keep-Alive"} {
+			if v := h.Get(name); v != "" {
+				t.Errorf("%s: found header %s: %q", where, name, v)
+			}
+		}
+		if got := h.Get("Etag"); got != `"abc"` {
+			t.Errorf("%s: got Etag %q, want %q", where, got, `"abc"`)
+		}
+	}
+
+	for _, path := range []string{"/immutable", "/volatile"} {
+		origin.get(t, s, path)
+		rsp := origin.get(t, s, path)
+		if got := rsp.Header().Get("X-Cache"); !strings.HasPrefix(got, "hit") {
+			t.Errorf("Get %s: got X-Cache %q, want hit", path, got)
+		}
+		checkHeader("serve "+path, rsp.Header())
+	}
+
+	_, hdr, err := s.cacheLoadLocal(origin.hash(t, "/immutable"))
+	if err != nil {
+		t.Fatalf("Load local: %v", err)
+	}
+	checkHeader("local", hdr)
+
+	_, hdr, err = s.cacheLoadMemory(origin.hash(t, "/volatile"))
+	if err != nil {
+		t.Fatalf("Load memory: %v", err)
+	}
+	checkHeader("memory", hdr)
+}
+
+func TestStaleWarnings(t *testing.T) {
+	// The origin reports each object as having been fetched 10 seconds ago,
+	// so that cached copies are already stale.
+	newStaleProxy := func(t *testing.T, cc string, fail *atomic.Bool) (*Server, *testOrigin) {
+		return newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			if fail.Load() {
+				http.Error(w, "origin failed", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Cache-Control", cc)
+			w.Header().Set("Date", time.Now().Add(-10*time.Second).UTC().Format(http.TimeFormat))
+			w.Write([]byte("stale content"))
+		})
+	}
+	checkStale := func(t *testing.T, rsp *httptest.ResponseRecorder, xcache string, warnings ...string) {
+		t.Helper()
+		if rsp.Code != http.StatusOK {
+			t.Fatalf("Got status %d, want %d", rsp.Code, http.StatusOK)
+		}
+		if got := rsp.Header().Get("X-Cache"); got != xcache {
+			t.Errorf("Got X-Cache %q, want %q", got, xcache)
+		}
+		if got := rsp.Header().Values("Warning"); !slices.Equal(got, warnings) {
+			t.Errorf("Got Warning %q, want %q", got, warnings)
+		}
+		if got := rsp.Body.String(); got != "stale content" {
+			t.Errorf("Body: got %q, want %q", got, "stale content")
+		}
+	}
+
+	t.Run("HotKey", func(t *testing.T) {
+		var fail atomic.Bool
+		s, origin := newStaleProxy(t, "max-age=5", &fail)
+		s.HotKeyThreshold = 1
+
+		origin.get(t, s, "/a")
+		checkStale(t, origin.get(t, s, "/a"), "hit, memory, stale", warnStale)
+
+		// Wait for the background refresh to finish.
+		for origin.requests.Load() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("StaleIfError", func(t *testing.T) {
+		var fail atomic.Bool
+		s, origin := newStaleProxy(t, "max-age=5, stale-if-error=60", &fail)
+
+		origin.get(t, s, "/a")
+		fail.Store(true)
+		checkStale(t, origin.get(t, s, "/a"), "hit, stale", warnStale, warnRevalidationFailed)
+	})
+
+	t.Run("Disconnected", func(t *testing.T) {
+		var fail atomic.Bool
+		s, origin := newStaleProxy(t, "max-age=5", &fail)
+		s.OriginErrorThreshold = 1
+
+		origin.get(t, s, "/a")
+		fail.Store(true)
+
+		// Without stale-if-error, the first failure is reported, and opens the
+		// circuit. After that, the stale copy is served without contacting the
+		// origin.
+		if rsp := origin.get(t, s, "/a"); rsp.Code != http.StatusInternalServerError {
+			t.Errorf("Got status %d, want %d", rsp.Code, http.StatusInternalServerError)
+		}
+		checkStale(t, origin.get(t, s, "/a"), "hit, stale", warnStale, warnDisconnected)
+		if got := origin.requests.Load(); got != 2 {
+			t.Errorf("Origin requests: got %d, want 2", got)
+		}
+	})
+}
+
+func TestCrossTierServe(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected origin request: %s %s", r.Method, r.URL)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	})
+	s.PreserveHeaders = []string{"X-Hint"}
+
+	const body = "the same content everywhere"
+	hash := origin.hash(t, "/obj")
+	hdr := http.Header{
+		"Cache-Control": {"max-age=1800"},
+		"Date":          {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)},
+		"Etag":          {`"v1"`},
+		"X-Hint":        {"b", "a"},
+		"X-Trace-Id":    {"not stored"},
+	}
+
+	// render returns the serialized response, omitting X-Cache, which reports
+	// the tier, and Age, which depends on when the response was served.
+	render := func(rsp *httptest.ResponseRecorder) string {
+		h := rsp.Header().Clone()
+		h.Del("X-Cache")
+		h.Del("Age")
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d\n", rsp.Code)
+		h.Write(&sb)
+		sb.WriteString("\n")
+		sb.WriteString(rsp.Body.String())
+		return sb.String()
+	}
+	serve := func(wantXCache string) string {
+		t.Helper()
+		rsp := origin.get(t, s, "/obj")
+		if got := rsp.Header().Get("X-Cache"); got != wantXCache {
+			t.Errorf("Got X-Cache %q, want %q", got, wantXCache)
+		}
+		if rsp.Header().Get("Age") == "" {
+			t.Errorf("Response from %q has no Age header", wantXCache)
+		}
+		return render(rsp)
+	}
+
+	// Store the object in S3 only, and serve it from there, which also faults
+	// it in to the local cache. Then serve it from the local cache, and
+	// finally from memory.
+	if err := s.cacheStoreS3(hash, hdr, []byte(body))(); err != nil {
+		t.Fatalf("Store S3: %v", err)
+	}
+	remote := serve("hit, remote")
+	local := serve("hit, local")
+
+	s.cacheStoreMemory(hash, 30*time.Minute, hdr, []byte(body))
+	memory := serve("hit, memory")
+
+	if local != remote {
+		t.Errorf("Local and remote responses differ:\nlocal:\n%s\nremote:\n%s", local, remote)
+	}
+	if memory != remote {
+		t.Errorf("Memory and remote responses differ:\nmemory:\n%s\nremote:\n%s", memory, remote)
+	}
+	if strings.Contains(remote, "X-Trace-Id") || !strings.Contains(remote, "X-Hint: b\r\nX-Hint: a") {
+		t.Errorf("Unexpected headers in response:\n%s", remote)
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/immutable" {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Header().Set("Etag", `"empty"`)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s.CacheNoContent = true
+
+	for _, tc := range []struct {
+		path, hit string
+	}{
+		{"/immutable", "hit, local"},
+		{"/volatile", "hit, memory"},
+	} {
+		origin.get(t, s, tc.path)
+		rsp := origin.get(t, s, tc.path)
+		if got := rsp.Header().Get("X-Cache"); got != tc.hit {
+			t.Errorf("Get %s: got X-Cache %q, want %q", tc.path, got, tc.hit)
+		}
+		if rsp.Code != http.StatusNoContent {
+			t.Errorf("Get %s: got status %d, want %d", tc.path, rsp.Code, http.StatusNoContent)
+		}
+		if got := rsp.Header().Get("Etag"); got != `"empty"` {
+			t.Errorf("Get %s: got Etag %q, want %q", tc.path, got, `"empty"`)
+		}
+		if rsp.Body.Len() != 0 {
+			t.Errorf("Get %s: got body %q, want empty", tc.path, rsp.Body)
+		}
+	}
+	if got := origin.requests.Load(); got != 2 {
+		t.Errorf("Origin requests: got %d, want 2", got)
+	}
+
+	// Check that the stored object round-trips, with an empty body.
+	var buf bytes.Buffer
+	hdr := withStatus(http.Header{"Etag": {`"empty"`}}, http.StatusNoContent)
+	if err := writeCacheObject(&buf, hdr, nil); err != nil {
+		t.Fatalf("Write object: %v", err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+		t.Errorf("Object does not end with a blank line:\n%s", buf.Bytes())
+	}
+	body, got, err := parseCacheObject(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Parse object: %v", err)
+	}
+	if len(body) != 0 {
+		t.Errorf("Got body %q, want empty", body)
+	}
+	if code := cachedStatus(got); code != http.StatusNoContent {
+		t.Errorf("Got status %d, want %d", code, http.StatusNoContent)
+	}
+	if etag := got.Get("Etag"); etag != `"empty"` {
+		t.Errorf("Got Etag %q, want %q", etag, `"empty"`)
+	}
+}
+
+func TestMalformedCacheControl(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+		maxAge      time.Duration // 0 means absent
+		want        string        // sanitized header
+	}{
+		{"NotANumber", "max-age=abc, public", 0, "public"},
+		{"MissingValue", "max-age, public", 0, "public"},
+		{"Empty", "max-age=", 0, ""},
+		{"Negative", "max-age=-1", 0, "max-age=0"},
+		{"Conflict", "max-age=600, max-age=60", time.Minute, "max-age=60"},
+		{"ConflictInvalid", "max-age=bogus, max-age=60", time.Minute, "max-age=60"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cc := parseCacheControl(tc.input)
+			if !cc.Malformed {
+				t.Errorf("Parse %q: not reported as malformed", tc.input)
+			}
+			if tc.maxAge != 0 && cc.MaxAge != tc.maxAge {
+				t.Errorf("Parse %q: got max-age %v, want %v", tc.input, cc.MaxAge, tc.maxAge)
+			}
+
+			s := &Server{Logf: t.Logf}
+			h := http.Header{"Cache-Control": {tc.input}}
+			s.sanitizeCacheControl(h)
+			if got := h.Get("Cache-Control"); got != tc.want {
+				t.Errorf("Sanitize %q: got %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		cc := parseCacheControl(`Max-Age="60", max-age=60, no-transform`)
+		if cc.Malformed || cc.MaxAge != time.Minute || !cc.Keys.Has("no-transform") {
+			t.Errorf("Parse: got %+v, want valid max-age of 1m", cc)
+		}
+		// Values too large to represent are valid, and capped.
+		if cc := parseCacheControl("max-age=99999999999999999999"); cc.Malformed || cc.MaxAge != maxDeltaSeconds*time.Second {
+			t.Errorf("Parse: got %+v, want max-age of %d seconds", cc, maxDeltaSeconds)
+		}
+	})
+
+	t.Run("MinFresh", func(t *testing.T) {
+		// For a request, the longer min-fresh is the more restrictive.
+		if cc := parseCacheControl("min-fresh=10, min-fresh=30"); cc.MinFresh != 30*time.Second {
+			t.Errorf("Parse: got min-fresh %v, want 30s", cc.MinFresh)
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=soon")
+			w.Write([]byte("hello"))
+		})
+		s.DefaultMaxAge = time.Minute
+
+		if rsp := origin.get(t, s, "/a"); rsp.Header().Get("X-Cache") != "fetch, cached, volatile" {
+			t.Errorf("First request: got X-Cache %q", rsp.Header().Get("X-Cache"))
+		}
+		rsp := origin.get(t, s, "/a")
+		if got := rsp.Header().Get("X-Cache"); got != "hit, memory" {
+			t.Errorf("Second request: got X-Cache %q, want hit", got)
+		}
+		if got := rsp.Header().Get("Cache-Control"); got != "max-age=60" {
+			t.Errorf("Got Cache-Control %q, want max-age=60", got)
+		}
+		if got := s.rspMalformedCC.Value(); got != 1 {
+			t.Errorf("Malformed responses: got %d, want 1", got)
+		}
+	})
+}
+
+func TestChunkedResponse(t *testing.T) {
+	chunks := []string{"first chunk, ", "second chunk, ", "last chunk"}
+	want := strings.Join(chunks, "")
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/immutable" {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		// Flushing before the handler returns makes the server send the
+		// response chunked, without a Content-Length.
+		for _, c := range chunks {
+			w.Write([]byte(c))
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	// Make sure the origin really does send a chunked response.
+	rsp, err := http.Get(origin.URL + "/immutable")
+	if err != nil {
+		t.Fatalf("Get origin: %v", err)
+	}
+	rsp.Body.Close()
+	if !slices.Equal(rsp.TransferEncoding, []string{"chunked"}) || rsp.ContentLength != -1 {
+		t.Fatalf("Origin response: got encoding %q, length %d; want chunked", rsp.TransferEncoding, rsp.ContentLength)
+	}
+
+	for _, tc := range []struct {
+		path, hit string
+	}{
+		{"/immutable", "hit, local"},
+		{"/volatile", "hit, memory"},
+	} {
+		if rsp := origin.get(t, s, tc.path); rsp.Body.String() != want {
+			t.Errorf("Get %s: got body %q, want %q", tc.path, rsp.Body, want)
+		}
+		rsp := origin.get(t, s, tc.path)
+		if got := rsp.Header().Get("X-Cache"); got != tc.hit {
+			t.Errorf("Get %s: got X-Cache %q, want %q", tc.path, got, tc.hit)
+		}
+		if got := rsp.Body.String(); got != want {
+			t.Errorf("Get %s: got body %q, want %q", tc.path, got, want)
+		}
+		if got := rsp.Header().Get("Content-Length"); got != fmt.Sprint(len(want)) {
+			t.Errorf("Get %s: got Content-Length %q, want %d", tc.path, got, len(want))
+		}
+		if te := rsp.Header().Values("Transfer-Encoding"); len(te) != 0 {
+			t.Errorf("Get %s: got Transfer-Encoding %q, want none", tc.path, te)
+		}
+	}
+
+	// The stored object records the length, and not the transfer encoding,
+	// even if the latter is configured to be preserved.
+	s.PreserveHeaders = []string{"Transfer-Encoding"}
+	hdr := s.trimCacheHeader(http.Header{"Transfer-Encoding": {"chunked"}})
+	var buf bytes.Buffer
+	if err := writeCacheObject(&buf, hdr, []byte(want)); err != nil {
+		t.Fatalf("Write object: %v", err)
+	}
+	_, got, err := parseCacheObject(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Parse object: %v", err)
+	}
+	if te := got.Values("Transfer-Encoding"); len(te) != 0 {
+		t.Errorf("Stored object has Transfer-Encoding %q", te)
+	}
+	if cl := got.Get("Content-Length"); cl != fmt.Sprint(len(want)) {
+		t.Errorf("Stored object has Content-Length %q, want %d", cl, len(want))
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, immutable")
+		w.Header().Set("Etag", `"abc123"`)
+		w.Write([]byte("console.log('hello')"))
+	})
+
+	origin.get(t, s, "/app.abc123.js")
+
+	// The object expires within 60 seconds, but it is immutable, so we do not
+	// need to ask the origin for a fresher copy.
+	rsp := origin.get(t, s, "/app.abc123.js", "Cache-Control", "min-fresh=120")
+	if got := rsp.Header().Get("X-Cache"); got != "hit, local" {
+		t.Errorf("Got X-Cache %q, want hit", got)
+	}
+	if got := rsp.Header().Get("Cache-Control"); got != "max-age=60, immutable" {
+		t.Errorf("Got Cache-Control %q, want immutable", got)
+	}
+	if got := origin.requests.Load(); got != 1 {
+		t.Errorf("Origin requests: got %d, want 1", got)
+	}
+
+	// Unless we are told to revalidate immutable objects.
+	s.RevalidateImmutable = true
+	origin.get(t, s, "/app.abc123.js", "Cache-Control", "min-fresh=120")
+	if got := origin.requests.Load(); got != 2 {
+		t.Errorf("Origin requests: got %d, want 2", got)
+	}
+}
+
+func TestSharedMaxAge(t *testing.T) {
+	now := time.Now()
+	date := now.Add(-2 * time.Minute).UTC().Format(http.TimeFormat)
+	for _, tc := range []struct {
+		name, cc, expires string
+		fresh             bool
+	}{
+		{"SMaxAgeShorter", "max-age=3600, s-maxage=60", "", false},
+		{"SMaxAgeLonger", "max-age=60, s-maxage=3600", "", true},
+		{"SMaxAgeZero", "max-age=3600, s-maxage=0", "", false},
+		{"MaxAgeOverExpires", "max-age=3600", now.Add(-time.Minute).UTC().Format(http.TimeFormat), true},
+		{"ExpiresFuture", "", now.Add(time.Hour).UTC().Format(http.TimeFormat), true},
+		{"ExpiresPast", "", now.Add(-time.Minute).UTC().Format(http.TimeFormat), false},
+		{"ExpiresInvalid", "", "0", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr := http.Header{"Date": {date}}
+			if tc.cc != "" {
+				hdr.Set("Cache-Control", tc.cc)
+			}
+			if tc.expires != "" {
+				hdr.Set("Expires", tc.expires)
+			}
+			if got := isFresh(hdr, now); got != tc.fresh {
+				t.Errorf("isFresh(%v): got %v, want %v", hdr, got, tc.fresh)
+			}
+		})
+	}
+
+	// The proxy uses s-maxage for its own lifetime, but passes max-age on to
+	// clients unchanged.
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=7200, s-maxage=60")
+		w.Write([]byte("hello"))
+	})
+	origin.get(t, s, "/a")
+	rsp := origin.get(t, s, "/a")
+	if got := rsp.Header().Get("X-Cache"); got != "hit, memory" {
+		t.Errorf("Got X-Cache %q, want a memory hit for a 60s lifetime", got)
+	}
+	if got := rsp.Header().Get("Cache-Control"); got != "max-age=7200, s-maxage=60" {
+		t.Errorf("Got Cache-Control %q, want it passed through", got)
+	}
+	e, ok := s.mcache.Get(origin.hash(t, "/a"))
+	if !ok {
+		t.Fatal("Entry not found in memory cache")
+	}
+	if d := time.Until(e.removeAt); d > time.Minute+time.Second {
+		t.Errorf("Memory entry retained for %v, want at most 1m", d)
+	}
+}
+
+func TestPartialContent(t *testing.T) {
+	const content = "hello world"
+	newProxy := func(t *testing.T) (*Server, *testOrigin) {
+		return newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		})
+	}
+	check := func(t *testing.T, rsp *httptest.ResponseRecorder, code int, xcache, body string) {
+		t.Helper()
+		if rsp.Code != code {
+			t.Errorf("Got status %d, want %d", rsp.Code, code)
+		}
+		if got := rsp.Header().Get("X-Cache"); got != xcache {
+			t.Errorf("Got X-Cache %q, want %q", got, xcache)
+		}
+		if got := rsp.Body.String(); got != body {
+			t.Errorf("Got body %q, want %q", got, body)
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		s, origin := newProxy(t)
+
+		// A forwarded partial response is passed through, but not cached.
+		check(t, origin.get(t, s, "/a", "Range", "bytes=0-4"), http.StatusPartialContent, "fetch, uncached", "hello")
+		if s.mcache.Has(origin.hash(t, "/a")) || fileExists(s.makePath(origin.hash(t, "/a"))) {
+			t.Fatal("Partial response was cached as the complete object")
+		}
+
+		// So a request for the complete object goes to the origin.
+		check(t, origin.get(t, s, "/a"), http.StatusOK, "fetch, cached, volatile", content)
+		check(t, origin.get(t, s, "/a"), http.StatusOK, "hit, memory", content)
+		if got := origin.requests.Load(); got != 2 {
+			t.Errorf("Origin requests: got %d, want 2", got)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		s, origin := newProxy(t)
+		s.CachePartialContent = true
+
+		// A partial response is cached as a fragment for its range.
+		check(t, origin.get(t, s, "/a", "Range", "bytes=0-4"), http.StatusPartialContent, "fetch, cached, volatile", "hello")
+		rsp := origin.get(t, s, "/a", "Range", "bytes=0-4")
+		check(t, rsp, http.StatusPartialContent, "hit, memory", "hello")
+		if got, want := rsp.Header().Get("Content-Range"), "bytes 0-4/11"; got != want {
+			t.Errorf("Got Content-Range %q, want %q", got, want)
+		}
+
+		// The fragment does not satisfy other ranges, or the complete object.
+		check(t, origin.get(t, s, "/a", "Range", "bytes=6-10"), http.StatusPartialContent, "fetch, cached, volatile", "world")
+		check(t, origin.get(t, s, "/a"), http.StatusOK, "fetch, cached, volatile", content)
+		check(t, origin.get(t, s, "/a"), http.StatusOK, "hit, memory", content)
+		if got := origin.requests.Load(); got != 3 {
+			t.Errorf("Origin requests: got %d, want 3", got)
+		}
+	})
+}
+
+func TestPreferFreshestTier(t *testing.T) {
+	now := time.Now()
+	newHeader := func(age time.Duration) http.Header {
+		return http.Header{
+			"Cache-Control": {"max-age=3600"},
+			"Content-Type":  {"text/plain"},
+			"Date":          {now.Add(-age).UTC().Format(http.TimeFormat)},
+		}
+	}
+	for _, tc := range []struct {
+		name                 string
+		prefer               bool
+		localAge, remoteAge  time.Duration
+		wantBody, wantXCache string
+		wantLocal, wantS3    string // contents of each tier afterward
+	}{
+		{"Disabled", false, 30 * time.Minute, 0, "local", "hit, local", "local", "remote"},
+		{"RemoteFresher", true, 30 * time.Minute, 0, "remote", "hit, remote", "remote", "remote"},
+		{"LocalFresher", true, 0, 30 * time.Minute, "local", "hit, local", "local", "local"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("Unexpected origin request for %q", r.URL)
+			})
+			s.PreferFreshestTier = tc.prefer
+			hash := origin.hash(t, "/a")
+
+			// Make the tiers diverge, as if a write to one of them had failed.
+			if err := s.cacheStoreLocal(hash, newHeader(tc.localAge), []byte("local")); err != nil {
+				t.Fatalf("Store local: %v", err)
+			}
+			if err := s.cacheStoreS3(hash, newHeader(tc.remoteAge), []byte("remote"))(); err != nil {
+				t.Fatalf("Store S3: %v", err)
+			}
+
+			rsp := origin.get(t, s, "/a")
+			if got := rsp.Body.String(); got != tc.wantBody {
+				t.Errorf("Got body %q, want %q", got, tc.wantBody)
+			}
+			if got := rsp.Header().Get("X-Cache"); got != tc.wantXCache {
+				t.Errorf("Got X-Cache %q, want %q", got, tc.wantXCache)
+			}
+
+			// The staler tier is repaired in the background.
+			s.tasks.Wait()
+			if body, _, err := s.cacheLoadLocal(hash); err != nil {
+				t.Errorf("Load local: %v", err)
+			} else if string(body) != tc.wantLocal {
+				t.Errorf("Local copy: got %q, want %q", body, tc.wantLocal)
+			}
+			if body, _, err := s.readS3Object(context.Background(), hash); err != nil {
+				t.Errorf("Load S3: %v", err)
+			} else if string(body) != tc.wantS3 {
+				t.Errorf("S3 copy: got %q, want %q", body, tc.wantS3)
+			}
+		})
+	}
+}
+
+func TestVaryHeader(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, immutable")
+		w.Header().Add("Vary", "origin")
+		w.Header().Add("Vary", "Accept-Language, ORIGIN")
+		w.Write([]byte(strings.Repeat("hello ", 100)))
+	})
+	s.PrecomputeVariants = []string{"gzip"}
+	check := func(t *testing.T, rsp *httptest.ResponseRecorder, xcache, vary string) {
+		t.Helper()
+		if got := rsp.Header().Get("X-Cache"); got != xcache {
+			t.Errorf("Got X-Cache %q, want %q", got, xcache)
+		}
+		if got := rsp.Header().Values("Vary"); len(got) != 1 || got[0] != vary {
+			t.Errorf("Got Vary %q, want %q", got, vary)
+		}
+	}
+
+	origin.get(t, s, "/a")
+	s.tasks.Wait() // for the variant to be stored
+
+	// The stored Vary is normalized, and served with hits. Since the object
+	// has variants, it also lists Accept-Encoding.
+	check(t, origin.get(t, s, "/a"), "hit, local", "Origin, Accept-Language, Accept-Encoding")
+
+	// Including hits on a variant.
+	check(t, origin.get(t, s, "/a", "Accept-Encoding", "gzip"), "hit, local", "Origin, Accept-Language, Accept-Encoding")
+	if got := origin.requests.Load(); got != 1 {
+		t.Errorf("Origin requests: got %d, want 1", got)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	for _, tc := range []struct {
+		name, etag, inm string
+		want            int
+	}{
+		{"StrongMatch", `"abc"`, `"abc"`, http.StatusNotModified},
+		{"StrongMismatch", `"abc"`, `"xyz"`, http.StatusOK},
+		{"List", `"abc"`, `"xyz", "abc"`, http.StatusNotModified},
+		{"ListMismatch", `"abc"`, `"xyz", "uvw"`, http.StatusOK},
+		{"ListComma", `"a,b"`, `"a", "a,b"`, http.StatusNotModified},
+		{"WeakRequest", `"abc"`, `W/"xyz", W/"abc"`, http.StatusNotModified},
+		{"WeakStored", `W/"abc"`, `"abc"`, http.StatusNotModified},
+		{"Wildcard", `"abc"`, `*`, http.StatusNotModified},
+		{"WildcardNoETag", "", `*`, http.StatusNotModified},
+		{"NoETag", "", `"abc"`, http.StatusOK},
+		{"Malformed", `"abc"`, `abc, "abc"`, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				if tc.etag != "" {
+					w.Header().Set("Etag", tc.etag)
+				}
+				w.Write([]byte("hello"))
+			})
+			origin.get(t, s, "/a")
+
+			rsp := origin.get(t, s, "/a", "If-None-Match", tc.inm)
+			if rsp.Code != tc.want {
+				t.Errorf("If-None-Match %s: got status %d, want %d", tc.inm, rsp.Code, tc.want)
+			}
+			if got := rsp.Header().Get("X-Cache"); got != "hit, memory" {
+				t.Errorf("Got X-Cache %q, want hit", got)
+			}
+			if got := origin.requests.Load(); got != 1 {
+				t.Errorf("Origin requests: got %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestNoCacheResponse(t *testing.T) {
+	newProxy := func(t *testing.T, cc string) (*Server, *testOrigin, *atomic.Int64) {
+		var conditional atomic.Int64
+		s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cc)
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("hello"))
+		})
+		s.StoreNoCache = time.Minute
+		return s, origin, &conditional
+	}
+	check := func(t *testing.T, rsp *httptest.ResponseRecorder, xcache string) {
+		t.Helper()
+		if rsp.Code != http.StatusOK {
+			t.Errorf("Got status %d, want %d", rsp.Code, http.StatusOK)
+		}
+		if got := rsp.Header().Get("X-Cache"); got != xcache {
+			t.Errorf("Got X-Cache %q, want %q", got, xcache)
+		}
+		if got := rsp.Body.String(); got != "hello" {
+			t.Errorf("Got body %q, want %q", got, "hello")
+		}
+	}
+
+	t.Run("NoStore", func(t *testing.T) {
+		s, origin, conditional := newProxy(t, "no-store")
+
+		// The response is not stored, so each request fetches it in full.
+		check(t, origin.get(t, s, "/a"), "fetch, uncached")
+		if s.mcache.Has(origin.hash(t, "/a")) {
+			t.Error("Response with no-store was stored")
+		}
+		check(t, origin.get(t, s, "/a"), "fetch, uncached")
+		if got := conditional.Load(); got != 0 {
+			t.Errorf("Conditional requests: got %d, want 0", got)
+		}
+	})
+
+	t.Run("NoCache", func(t *testing.T) {
+		s, origin, conditional := newProxy(t, "no-cache")
+
+		// The response is stored, but each use is revalidated with the origin
+		// first, and served from the cache when not modified.
+		check(t, origin.get(t, s, "/a"), "fetch, cached, volatile")
+		if !s.mcache.Has(origin.hash(t, "/a")) {
+			t.Error("Response with no-cache was not stored")
+		}
+		check(t, origin.get(t, s, "/a"), "hit, revalidated")
+		check(t, origin.get(t, s, "/a"), "hit, revalidated")
+		if got := conditional.Load(); got != 2 {
+			t.Errorf("Conditional requests: got %d, want 2", got)
+		}
+		if got := origin.requests.Load(); got != 3 {
+			t.Errorf("Origin requests: got %d, want 3", got)
+		}
+	})
+
+	t.Run("NoCacheDisabled", func(t *testing.T) {
+		s, origin, conditional := newProxy(t, "no-cache")
+		s.StoreNoCache = 0
+
+		check(t, origin.get(t, s, "/a"), "fetch, uncached")
+		check(t, origin.get(t, s, "/a"), "fetch, uncached")
+		if got := conditional.Load(); got != 0 {
+			t.Errorf("Conditional requests: got %d, want 0", got)
+		}
+	})
+
+	t.Run("NoCacheImmutable", func(t *testing.T) {
+		s, origin, conditional := newProxy(t, "max-age=3600, immutable, no-cache")
+
+		// Even an object stored on disk is revalidated before each use.
+		origin.get(t, s, "/a")
+		check(t, origin.get(t, s, "/a"), "hit, revalidated")
+		if got := conditional.Load(); got != 1 {
+			t.Errorf("Conditional requests: got %d, want 1", got)
+		}
+	})
+}
+
+func TestRetainMetadata(t *testing.T) {
+	var conditional atomic.Int64
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	s.RetainMetadataAfterExpiry = time.Hour
+
+	// stub replaces the memory entry for hash with an expired stub.
+	stub := func(t *testing.T, hash string) {
+		t.Helper()
+		_, hdr, err := s.cacheLoadLocal(hash)
+		if err != nil {
+			t.Fatalf("Load local: %v", err)
+		}
+		hdr.Set("Date", time.Now().Add(-2*time.Hour).UTC().Format(http.TimeFormat))
+		s.memPut(hash, memCacheEntry{header: hdr, removeAt: time.Now().Add(time.Hour), stub: true})
+		if _, _, err := s.cacheLoadMemory(hash); !errors.Is(err, errHeaderOnly) {
+			t.Fatalf("Load stub: got %v, want %v", err, errHeaderOnly)
+		}
+	}
+	check := func(t *testing.T, rsp *httptest.ResponseRecorder, xcache string) {
+		t.Helper()
+		if got := rsp.Header().Get("X-Cache"); got != xcache {
+			t.Errorf("Got X-Cache %q, want %q", got, xcache)
+		}
+		if got := rsp.Body.String(); got != "hello" {
+			t.Errorf("Got body %q, want %q", got, "hello")
+		}
+	}
+
+	origin.get(t, s, "/a")
+	s.tasks.Wait()
+	hash := origin.hash(t, "/a")
+
+	// The stub is revalidated, and the body read from the local cache.
+	stub(t, hash)
+	check(t, origin.get(t, s, "/a"), "hit, revalidated")
+	if got := conditional.Load(); got != 1 {
+		t.Errorf("Conditional requests: got %d, want 1", got)
+	}
+	s.tasks.Wait()
+
+	// With no stored copy of the body, the object is fetched in full.
+	stub(t, hash)
+	if err := os.Remove(s.makePath(hash)); err != nil {
+		t.Fatalf("Remove local copy: %v", err)
+	}
+	if err := s.Bucket.Delete(context.Background(), s.makeKey(hash)); err != nil {
+		t.Fatalf("Delete S3 copy: %v", err)
+	}
+	check(t, origin.get(t, s, "/a"), "fetch, cached")
+	if got, want := origin.requests.Load(), int64(4); got != want {
+		t.Errorf("Origin requests: got %d, want %d", got, want)
+	}
+}
+
+func TestMissingDate(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Date"] = nil // suppress the default
+		if r.URL.Path == "/expires" {
+			w.Header().Set("Expires", time.Now().Add(30*time.Minute).UTC().Format(http.TimeFormat))
+		} else {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		}
+		w.Write([]byte("hello"))
+	})
+
+	// The stored object is given a Date, the time it was received.
+	before := time.Now().Truncate(time.Second)
+	if rsp := origin.get(t, s, "/a"); rsp.Header().Get("Date") == "" {
+		t.Error("Forwarded response has no Date")
+	}
+	_, hdr, err := s.cacheLoadLocal(origin.hash(t, "/a"))
+	if err != nil {
+		t.Fatalf("Load local object: %v", err)
+	}
+	date, err := http.ParseTime(hdr.Get("Date"))
+	if err != nil {
+		t.Fatalf("Stored Date %q: %v", hdr.Get("Date"), err)
+	} else if date.Before(before) || date.After(time.Now()) {
+		t.Errorf("Stored Date %v, want the time received", date)
+	}
+
+	// So hits are served with an Age.
+	rsp := origin.get(t, s, "/a")
+	if got := rsp.Header().Get("X-Cache"); got != "hit, local" {
+		t.Errorf("Got X-Cache %q, want hit", got)
+	}
+	if rsp.Header().Get("Age") == "" {
+		t.Error("Hit has no Age")
+	}
+
+	// And a lifetime given by Expires can be computed.
+	origin.get(t, s, "/expires")
+	if got := origin.get(t, s, "/expires").Header().Get("X-Cache"); got != "hit, memory" {
+		t.Errorf("Got X-Cache %q, want hit", got)
+	}
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	date := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) string { return date.Add(-d).Format(http.TimeFormat) }
+
+	for _, tc := range []struct {
+		name, cc, lastMod string
+		limit             time.Duration
+		want              time.Duration
+		ok                bool
+	}{
+		{"Fraction", "", ago(10 * time.Hour), 24 * time.Hour, time.Hour, true},
+		{"Capped", "", ago(100 * 24 * time.Hour), 24 * time.Hour, 24 * time.Hour, true},
+		{"ModifiedAfterDate", "", ago(-time.Hour), 24 * time.Hour, 0, true},
+		{"Public", "public", ago(10 * time.Hour), 24 * time.Hour, time.Hour, true},
+		{"MaxAge", "max-age=60", ago(10 * time.Hour), 24 * time.Hour, 0, false},
+		{"NoStore", "no-store", ago(10 * time.Hour), 24 * time.Hour, 0, false},
+		{"NoCache", "no-cache", ago(10 * time.Hour), 24 * time.Hour, 0, false},
+		{"NoLastModified", "", "", 24 * time.Hour, 0, false},
+		{"BadLastModified", "", "yesterday", 24 * time.Hour, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr := http.Header{"Date": {date.Format(http.TimeFormat)}}
+			if tc.cc != "" {
+				hdr.Set("Cache-Control", tc.cc)
+			}
+			if tc.lastMod != "" {
+				hdr.Set("Last-Modified", tc.lastMod)
+			}
+			got, ok := heuristicLifetime(hdr, 0.1, tc.limit)
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("heuristicLifetime: got %v, %v; want %v, %v", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+
+	t.Run("Server", func(t *testing.T) {
+		s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Last-Modified", time.Now().Add(-30*24*time.Hour).UTC().Format(http.TimeFormat))
+			w.Write([]byte("hello"))
+		})
+		s.HeuristicFreshnessMax = 10 * time.Minute
+
+		// The response is given the capped heuristic lifetime, and cached. The
+		// lifetime is stored with the object, not sent to the client.
+		rsp := origin.get(t, s, "/a")
+		if got := rsp.Header().Get("Cache-Control"); got != "" {
+			t.Errorf("Got Cache-Control %q, want none", got)
+		}
+		if got := rsp.Header().Get(lifetimeHeader); got != "" {
+			t.Errorf("Got %s %q, want none", lifetimeHeader, got)
+		}
+		if e, ok := s.memGet(origin.hash(t, "/a")); !ok {
+			t.Error("Object not cached in memory")
+		} else if lt, _ := freshnessLifetime(e.header); lt != 10*time.Minute {
+			t.Errorf("Stored lifetime: got %v, want %v", lt, 10*time.Minute)
+		}
+		if got := origin.get(t, s, "/a").Header().Get("X-Cache"); got != "hit, memory" {
+			t.Errorf("Got X-Cache %q, want hit", got)
+		}
+		if got := origin.requests.Load(); got != 1 {
+			t.Errorf("Origin requests: got %d, want 1", got)
+		}
+	})
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	body := strings.Repeat("hello, world\n", 100)
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Write([]byte(body))
+	})
+	s.PrecomputeVariants = []string{"gzip"}
+
+	// Store the object and its precomputed variant.
+	origin.get(t, s, "/a")
+	s.tasks.Wait()
+
+	for _, tc := range []struct {
+		accept string // "" for none
+		want   string // Content-Encoding of the response
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP;Q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0.000", ""},
+		{"gzip;q=0, *", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"*;q=0, identity", ""},
+		{"*;q=0.5, gzip;q=0", ""},
+		{"gzip;q=0.5, *", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip, identity;q=0", "gzip"},
+		{"identity;q=0", ""},
+		{"identity;q=0, *", "gzip"},
+		{"br, deflate", ""},
+		{"gzip;q=bogus", ""},
+	} {
+		t.Run(tc.accept, func(t *testing.T) {
+			var hdrs []string
+			if tc.accept != "" {
+				hdrs = []string{"Accept-Encoding", tc.accept}
+			}
+			rsp := origin.get(t, s, "/a", hdrs...)
+			if got := rsp.Header().Get("Content-Encoding"); got != tc.want {
+				t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tc.accept, got, tc.want)
+			}
+			if tc.want == "" && rsp.Body.String() != body {
+				t.Errorf("Accept-Encoding %q: got body %q, want the original", tc.accept, rsp.Body.String())
+			}
+		})
+	}
+	if got := origin.requests.Load(); got != 1 {
+		t.Errorf("Origin requests: got %d, want 1", got)
+	}
+}
+
+func TestValidateVariants(t *testing.T) {
+	tests := []struct {
+		encs []string
+		want string // error substring, or "" for none
+	}{
+		{nil, ""},
+		{[]string{"gzip"}, ""},
+		{[]string{"gzip", "br"}, `"br" is not implemented`},
+		{[]string{"deflate"}, `unsupported precomputed variant encoding "deflate"`},
+	}
+	for _, tc := range tests {
+		s := &Server{PrecomputeVariants: tc.encs}
+		err := s.Validate()
+		if tc.want == "" && err != nil {
+			t.Errorf("Validate %q: unexpected error: %v", tc.encs, err)
+		} else if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("Validate %q: got %v, want error containing %q", tc.encs, err, tc.want)
+		}
+	}
+}
+
+func TestVariantChecksum(t *testing.T) {
+	body := strings.Repeat("hello, world\n", 100)
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Write([]byte(body))
+	})
+	s.PrecomputeVariants = []string{"gzip"}
+	s.ChecksumPolicy = func(string, int64) ChecksumAlgorithm { return ChecksumCRC32C }
+	s.S3ReadValidate = true
+
+	origin.get(t, s, "/a")
+	s.tasks.Wait()
+
+	// The variant records the checksum of its own body, in both tiers.
+	vhash := variantHash(origin.hash(t, "/a"), "gzip")
+	if _, hdr, err := s.cacheLoadLocal(vhash); err != nil {
+		t.Fatalf("Load local variant: %v", err)
+	} else if got := hdr.Get(checksumAlgoHeader); got != ChecksumCRC32C.String() {
+		t.Errorf("Variant checksum algorithm: got %q, want %q", got, ChecksumCRC32C)
+	}
+	if _, _, err := s.cacheLoadS3(context.Background(), vhash); err != nil {
+		t.Fatalf("Load S3 variant: %v", err)
+	}
+
+	// With only the S3 copies, the validated variant is served.
+	for _, h := range []string{origin.hash(t, "/a"), vhash} {
+		if err := os.Remove(s.makePath(h)); err != nil {
+			t.Fatalf("Remove local copy: %v", err)
+		}
+	}
+	s.mcache.Clear()
+	rsp := origin.get(t, s, "/a", "Accept-Encoding", "gzip")
+	if got := rsp.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Got Content-Encoding %q, want gzip (X-Cache %q)", got, rsp.Header().Get("X-Cache"))
+	}
+	if got := origin.requests.Load(); got != 1 {
+		t.Errorf("Origin requests: got %d, want 1", got)
+	}
+}
+
+func TestExistsLongHeader(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("X-Padding", strings.Repeat("x", 2*existsHeaderBytes))
+		w.Write([]byte("hello, world"))
+	})
+	s.PreserveHeaders = []string{"X-Padding"}
+	origin.get(t, s, "/a")
+	s.tasks.Wait()
+
+	// With only the S3 copy, whose header is longer than the range read by
+	// Exists, the header is read in full.
+	hash := origin.hash(t, "/a")
+	if err := os.Remove(s.makePath(hash)); err != nil {
+		t.Fatalf("Remove local copy: %v", err)
+	}
+	s.mcache.Clear()
+	present, fresh, err := s.Exists(context.Background(), hash)
+	if err != nil || !present || !fresh {
+		t.Errorf("Exists: got (%v, %v, %v), want (true, true, nil)", present, fresh, err)
+	}
+}
+
+func TestHTTP10Client(t *testing.T) {
+	chunks := []string{"first chunk, ", "second chunk, ", "last chunk"}
+	want := strings.Join(chunks, "")
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range chunks {
+			w.Write([]byte(c))
+			w.(http.Flusher).Flush()
+		}
+	})
+	proxy := httptest.NewServer(s)
+	t.Cleanup(proxy.Close)
+
+	// send sends a proxy request for path with the given protocol version,
+	// and returns the response.
+	send := func(t *testing.T, proto, path string) (*http.Response, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial proxy: %v", err)
+		}
+		defer conn.Close()
+		u, _ := url.Parse(origin.URL)
+		fmt.Fprintf(conn, "GET %s%s %s\r\nHost: %s\r\nConnection: close\r\n\r\n", origin.URL, path, proto, u.Host)
+		rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Read response: %v", err)
+		}
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatalf("Read body: %v", err)
+		}
+		return rsp, string(body)
+	}
+
+	t.Run("HTTP/1.0", func(t *testing.T) {
+		rsp, body := send(t, "HTTP/1.0", "/a")
+		if body != want {
+			t.Errorf("Got body %q, want %q", body, want)
+		}
+		if rsp.ContentLength != int64(len(want)) || len(rsp.TransferEncoding) != 0 {
+			t.Errorf("Got encoding %q, length %d; want length %d", rsp.TransferEncoding, rsp.ContentLength, len(want))
+		}
+	})
+
+	t.Run("HTTP/1.1", func(t *testing.T) {
+		rsp, body := send(t, "HTTP/1.1", "/a")
+		if body != want {
+			t.Errorf("Got body %q, want %q", body, want)
+		}
+		if !slices.Equal(rsp.TransferEncoding, []string{"chunked"}) {
+			t.Errorf("Got encoding %q, want chunked", rsp.TransferEncoding)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		s.LegacyBufferBytes = 5
+		defer func() { s.LegacyBufferBytes = 0 }()
+
+		// The body is sent whole, delimited by the end of the connection.
+		rsp, body := send(t, "HTTP/1.0", "/a")
+		if body != want {
+			t.Errorf("Got body %q, want %q", body, want)
+		}
+		if rsp.ContentLength != -1 || len(rsp.TransferEncoding) != 0 {
+			t.Errorf("Got encoding %q, length %d; want neither", rsp.TransferEncoding, rsp.ContentLength)
+		}
+	})
+}
+
+func TestSelfHealDefault(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Write([]byte("hello"))
+	})
+	origin.get(t, s, "/a")
+	s.tasks.Wait()
+
+	// Corrupt the local copy, and leave no other copy to read.
+	hash := origin.hash(t, "/a")
+	if err := os.WriteFile(s.makePath(hash), []byte("garbage"), 0644); err != nil {
+		t.Fatalf("Corrupt local copy: %v", err)
+	}
+	if err := s.Bucket.Delete(context.Background(), s.makeKey(hash)); err != nil {
+		t.Fatalf("Delete S3 copy: %v", err)
+	}
+	s.mcache.Clear()
+
+	// With SelfHealCorruption unset, the corrupt object is repaired.
+	if got := origin.get(t, s, "/a").Body.String(); got != "hello" {
+		t.Errorf("Got body %q, want hello", got)
+	}
+	if got := s.reqSelfHeal.Value(); got != 1 {
+		t.Errorf("Self-heals: got %d, want 1", got)
+	}
+}
+
+func TestPurgeS3Buckets(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Write([]byte("hello"))
+	})
+	for range 3 {
+		b := memblob.OpenBucket(nil)
+		t.Cleanup(func() { b.Close() })
+		s.S3Buckets = append(s.S3Buckets, b)
+	}
+
+	// Leave a copy of the object in every bucket, as if it were stored
+	// before the buckets changed.
+	origin.get(t, s, "/a")
+	s.tasks.Wait()
+	hash := origin.hash(t, "/a")
+	obj, err := s.bucket(hash).ReadAll(context.Background(), s.makeKey(hash))
+	if err != nil {
+		t.Fatalf("Read S3 copy: %v", err)
+	}
+	for _, b := range s.S3Buckets {
+		if err := b.WriteAll(context.Background(), s.makeKey(hash), obj, nil); err != nil {
+			t.Fatalf("Write S3 copy: %v", err)
+		}
+	}
+
+	if err := s.Purge(context.Background(), hash); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	for i, b := range s.S3Buckets {
+		if ok, err := b.Exists(context.Background(), s.makeKey(hash)); err != nil || ok {
+			t.Errorf("Bucket %d: exists=%v, err=%v after purge", i, ok, err)
+		}
+	}
+}
+
+func TestIdleAfterUnpin(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	s.MemoryIdleTimeout = 20 * time.Millisecond
+
+	origin.get(t, s, "/a")
+	hash := origin.hash(t, "/a")
+	s.Pin(hash)
+
+	// A pinned entry is not removed for idleness.
+	time.Sleep(60 * time.Millisecond)
+	if !s.memHas(hash) {
+		t.Fatal("Pinned entry was removed")
+	}
+
+	// Once unpinned, it is checked for idleness again.
+	s.Unpin(hash)
+	time.Sleep(80 * time.Millisecond)
+	if s.memHas(hash) {
+		t.Error("Idle entry was not removed after Unpin")
+	}
+	if got := s.memIdleEvict.Value(); got != 1 {
+		t.Errorf("Idle evictions: got %d, want 1", got)
+	}
+}
+
+func TestAbandonFlight(t *testing.T) {
+	s := &Server{MaxCoalesceBodyBytes: 10}
+	large := &http.Response{ContentLength: 100}
+	isDone := func(f *flight) bool {
+		select {
+		case <-f.done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	lead, _ := s.joinFlight(context.Background(), "k")
+	if lead == nil {
+		t.Fatal("First request did not lead the flight")
+	}
+
+	// Only the leader of the flight can abandon it.
+	s.abandonFlight("k", nil, large)
+	s.abandonFlight("k", &flight{done: make(chan struct{})}, large)
+	if isDone(lead) {
+		t.Fatal("Flight abandoned by a request that does not lead it")
+	}
+	s.abandonFlight("k", lead, large)
+	if !isDone(lead) || !lead.abandoned {
+		t.Error("Flight not abandoned by its leader")
+	}
+	s.endFlight("k", lead) // must not close the flight again
+}
+
+func TestPurgeBodyEvictFirst(t *testing.T) {
+	s, origin := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	s.BodyEvictFirst = true
+
+	origin.get(t, s, "/a")
+	hash := origin.hash(t, "/a")
+	if !s.memHas(hash) {
+		t.Fatal("Object not cached in memory")
+	}
+	if err := s.Purge(context.Background(), hash); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+
+	// A purged entry is removed, not demoted to the local cache.
+	time.Sleep(50 * time.Millisecond)
+	if s.memHas(hash) || fileExists(s.makePath(hash)) {
+		t.Error("Purged object was demoted")
+	}
+	if got := origin.get(t, s, "/a").Header().Get("X-Cache"); strings.HasPrefix(got, "hit") {
+		t.Errorf("Got X-Cache %q after purge, want a miss", got)
+	}
+	if got := origin.requests.Load(); got != 2 {
+		t.Errorf("Origin requests: got %d, want 2", got)
+	}
+	if got := s.rspDemoteMem.Value(); got != 0 {
+		t.Errorf("Demoted entries: got %d, want 0", got)
+	}
+}
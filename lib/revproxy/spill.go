@@ -0,0 +1,190 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+)
+
+// bodyBuffer accumulates the body of a response to be stored in the cache.
+// The body is held in memory, unless its size exceeds the spill limit, in
+// which case it is written to a temporary file instead. The checksum of the
+// body is computed as it is written, with the algorithm chosen when the buffer
+// is created, so that it is ready as soon as the response has been copied to
+// the client, and storing the object does not have to wait for a separate
+// pass over the body.
+//
+// Write errors are recorded rather than reported, so that a bodyBuffer can be
+// used with an [io.TeeReader] without interrupting the response to the client.
+// Use Err to check whether the buffer is complete.
+type bodyBuffer struct {
+	dir   string // directory for the spill file
+	limit int64  // spill after this many bytes; 0 means never
+
+	mem   bytes.Buffer
+	file  *os.File // spill file, or nil
+	n     int64
+	algo  ChecksumAlgorithm
+	sum   hash.Hash
+	known string // if non-empty, the checksum of a previously-stored body
+	err   error
+}
+
+// newBodyBuffer returns a bodyBuffer that spills to a temporary file in dir
+// after limit bytes, and computes the checksum of its contents with algo. If
+// limit <= 0, the buffer never spills.
+func newBodyBuffer(dir string, limit int64, algo ChecksumAlgorithm) *bodyBuffer {
+	sum := hash.Hash(sha256.New())
+	if algo == ChecksumCRC32C {
+		sum = crc32.New(crc32c)
+	}
+	return &bodyBuffer{dir: dir, limit: limit, algo: algo, sum: sum}
+}
+
+// bytesBody returns an in-memory bodyBuffer containing data, with its SHA-256
+// digest.
+func bytesBody(data []byte) *bodyBuffer { return bytesBodyAs(data, ChecksumSHA256) }
+
+// bytesBodyAs returns an in-memory bodyBuffer containing data, with its
+// checksum computed by algo.
+func bytesBodyAs(data []byte, algo ChecksumAlgorithm) *bodyBuffer {
+	b := newBodyBuffer("", 0, algo)
+	b.Write(data)
+	return b
+}
+
+// storedBody returns an in-memory bodyBuffer containing data, the body of a
+// stored cache object with header h, with its SHA-256 digest. If h records the
+// digest of the body, it is used rather than being computed again. The result
+// must not be written.
+func storedBody(h http.Header, data []byte) *bodyBuffer {
+	return storedBodyAs(h, data, ChecksumSHA256)
+}
+
+// storedBodyAs is as storedBody, with the checksum computed by algo. A
+// checksum recorded in h by another algorithm is not used.
+func storedBodyAs(h http.Header, data []byte, algo ChecksumAlgorithm) *bodyBuffer {
+	sum := recordedChecksum(h, algo)
+	if sum == "" {
+		return bytesBodyAs(data, algo)
+	}
+	return &bodyBuffer{mem: *bytes.NewBuffer(data), n: int64(len(data)), algo: algo, known: sum}
+}
+
+// Write implements [io.Writer]. It always reports success.
+func (b *bodyBuffer) Write(data []byte) (int, error) {
+	if b.err != nil {
+		return len(data), nil
+	}
+	b.sum.Write(data)
+	b.n += int64(len(data))
+	if b.file == nil && b.limit > 0 && b.n > b.limit {
+		f, err := os.CreateTemp(b.dir, ".spill-*")
+		if err != nil {
+			b.err = err
+			return len(data), nil
+		}
+		b.file = f
+		if _, err := f.Write(b.mem.Bytes()); err != nil {
+			b.err = err
+			return len(data), nil
+		}
+		b.mem = bytes.Buffer{}
+	}
+	if b.file != nil {
+		if _, err := b.file.Write(data); err != nil {
+			b.err = err
+		}
+	} else {
+		b.mem.Write(data)
+	}
+	return len(data), nil
+}
+
+// Len reports the total number of bytes written to b.
+func (b *bodyBuffer) Len() int64 { return b.n }
+
+// Spilled reports whether b has spilled to a temporary file.
+func (b *bodyBuffer) Spilled() bool { return b.file != nil }
+
+// Err reports the first error that occurred writing to b, if any.
+func (b *bodyBuffer) Err() error { return b.err }
+
+// Checksum returns the hex-encoded checksum of the contents of b, computed by
+// the algorithm of b.
+func (b *bodyBuffer) Checksum() string {
+	if b.known != "" {
+		return b.known
+	}
+	return fmt.Sprintf("%x", b.sum.Sum(nil))
+}
+
+// NewReader returns a reader for the contents of b, starting at the
+// beginning. Multiple readers may be used concurrently.
+func (b *bodyBuffer) NewReader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.n)
+	}
+	return bytes.NewReader(b.mem.Bytes())
+}
+
+// Bytes returns the complete contents of b. If b has spilled, the contents
+// are read back from the spill file.
+func (b *bodyBuffer) Bytes() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	} else if b.file == nil {
+		return b.mem.Bytes(), nil
+	}
+	return io.ReadAll(b.NewReader())
+}
+
+// Close releases the resources of b, removing its spill file if any.
+func (b *bodyBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+const (
+	// defaultStreamChunkSize is the default size of the buffer used to stream
+	// bodies, the same as used by [io.Copy].
+	defaultStreamChunkSize = 32 << 10
+
+	// minStreamChunkSize is the smallest StreamChunkSize that is honored.
+	minStreamChunkSize = 4 << 10
+)
+
+// streamChunkSize returns the size of the buffer used to stream bodies,
+// according to StreamChunkSize.
+func (s *Server) streamChunkSize() int {
+	if s.StreamChunkSize <= 0 {
+		return defaultStreamChunkSize
+	}
+	return max(s.StreamChunkSize, minStreamChunkSize)
+}
+
+// checkStreamChunkSize logs a warning if StreamChunkSize is below the minimum.
+func (s *Server) checkStreamChunkSize() {
+	if n := s.StreamChunkSize; n > 0 && n < minStreamChunkSize {
+		s.logf("warning: stream chunk size %d is too small, using %d", n, minStreamChunkSize)
+	}
+}
+
+// copyStream copies src to dst in chunks of buf, which may be nil to use a
+// buffer of the default size. Unlike [io.CopyBuffer], it does not defer to
+// the WriterTo or ReaderFrom methods of src and dst, so that the size of buf
+// governs the size of each read and write.
+func copyStream(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"expvar"
+
+	"github.com/creachadair/scheddle"
+)
+
+// Stats is a snapshot of the metrics of a [Server], keyed by the names used
+// in [Server.Metrics]. Counters are int64 values; other metrics have the
+// values of the corresponding [expvar.Func].
+type Stats map[string]any
+
+// Stats returns a snapshot of the current metrics of s.
+//
+// The metrics are read in a single pass, without stopping requests in
+// progress, so counters that are updated together by a request (such as
+// "rsp_save" and "rsp_save_bytes") may disagree by that request.
+func (s *Server) Stats() Stats {
+	out := make(Stats)
+	s.Metrics().Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			out[kv.Key] = v.Value()
+		case expvar.Func:
+			out[kv.Key] = v.Value()
+		default:
+			out[kv.Key] = v.String()
+		}
+	})
+	return out
+}
+
+// scheduleMetrics schedules the next delivery of metrics to the MetricsSink,
+// if enabled.
+func (s *Server) scheduleMetrics() {
+	if s.MetricsSink == nil || s.MetricsInterval <= 0 {
+		return
+	}
+	s.expire.After(s.MetricsInterval, scheddle.Run(func() {
+		s.start(func() error {
+			defer s.scheduleMetrics()
+			s.MetricsSink(s.Stats())
+			return nil
+		})
+	}))
+}
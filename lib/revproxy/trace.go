@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// traceHeader is the response header that carries the decision trace for a
+// traced request.
+const traceHeader = "X-Cache-Trace"
+
+// A decisionTrace records the steps taken by the cache to handle a single
+// request, for debugging. A nil *decisionTrace is valid and records nothing,
+// so that untraced requests pay only for a context lookup.
+type decisionTrace struct {
+	start time.Time
+
+	mu    sync.Mutex
+	Key   string      `json:"key"`
+	Steps []traceStep `json:"steps"`
+}
+
+// A traceStep is a single step of a decisionTrace.
+type traceStep struct {
+	Step   string `json:"step"`           // e.g., "memory", "origin", "store"
+	Result string `json:"result"`         // e.g., "hit", "miss", "200"
+	At     string `json:"at"`             // time since the request began
+	Took   string `json:"took,omitempty"` // duration of the step, if measured
+}
+
+type traceKey struct{}
+
+// withTrace returns a copy of r carrying a new decisionTrace for the request
+// with the given cache key, begun at start.
+func withTrace(r *http.Request, hash string, start time.Time) (*http.Request, *decisionTrace) {
+	tr := &decisionTrace{start: start, Key: hash}
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, tr)), tr
+}
+
+// traceOf returns the decisionTrace for r, or nil if r is not traced.
+func traceOf(r *http.Request) *decisionTrace {
+	tr, _ := r.Context().Value(traceKey{}).(*decisionTrace)
+	return tr
+}
+
+// add records a step with the given result. If since is not zero, the step is
+// reported as having begun at that time.
+func (t *decisionTrace) add(step, result string, since time.Time) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	ts := traceStep{Step: step, Result: result, At: now.Sub(t.start).String()}
+	if !since.IsZero() {
+		ts.Took = now.Sub(since).String()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Steps = append(t.Steps, ts)
+}
+
+// addf records a step with a formatted result.
+func (t *decisionTrace) addf(step string, since time.Time, msg string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.add(step, fmt.Sprintf(msg, args...), since)
+}
+
+// encode returns the JSON encoding of t.
+func (t *decisionTrace) encode() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data, err := json.Marshal(t)
+	if err != nil {
+		panic(fmt.Sprintf("encode trace: %v", err)) // should not be possible
+	}
+	return data
+}
+
+// setHeader adds the encoded trace to the response header h.
+func (t *decisionTrace) setHeader(h http.Header) {
+	h.Set(traceHeader, base64.StdEncoding.EncodeToString(t.encode()))
+}
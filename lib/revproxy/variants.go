@@ -0,0 +1,320 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// variantEncoders are the content encodings for which PrecomputeVariants can
+// generate variants, and the functions that encode them.
+var variantEncoders = map[string]func([]byte) ([]byte, error){
+	"gzip": func(data []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+// variantHash returns the storage digest of the variant of the object for
+// hash with the specified content encoding.
+func variantHash(hash, encoding string) string {
+	key := hash + "\nContent-Encoding: " + encoding
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// acceptEncoding is a parsed Accept-Encoding request header (RFC 9110 Section
+// 12.5.3), giving the quality value of each content coding listed.
+type acceptEncoding struct {
+	q    map[string]float64 // by lower-case coding name, including "*"
+	sent bool               // the request had an Accept-Encoding header
+}
+
+// parseAcceptEncoding parses the Accept-Encoding headers of h. An entry with
+// an invalid quality value is ignored, and if a coding is listed more than
+// once, the first entry is used.
+func parseAcceptEncoding(h http.Header) acceptEncoding {
+	vals := h.Values("Accept-Encoding")
+	out := acceptEncoding{q: make(map[string]float64), sent: len(vals) != 0}
+	for _, v := range vals {
+		for _, elt := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(elt, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			} else if _, ok := out.q[name]; ok {
+				continue
+			}
+			q, ok := parseQValue(params)
+			if ok {
+				out.q[name] = q
+			}
+		}
+	}
+	return out
+}
+
+// parseQValue parses the parameters of an Accept-Encoding entry, and returns
+// its quality value, 1 if it has none. It reports false if the value is not
+// a number between 0 and 1.
+func parseQValue(params string) (float64, bool) {
+	for _, p := range strings.Split(params, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, false
+		}
+		return q, true
+	}
+	return 1, true
+}
+
+// quality returns the quality value of the content coding enc: The value of
+// its own entry if it has one, otherwise that of the "*" entry. The identity
+// coding is acceptable unless excluded, and any other coding not listed is
+// not acceptable.
+func (a acceptEncoding) quality(enc string) float64 {
+	enc = strings.ToLower(enc)
+	if q, ok := a.q[enc]; ok {
+		return q
+	} else if q, ok := a.q["*"]; ok {
+		return q
+	} else if enc == "identity" {
+		return 1
+	}
+	return 0
+}
+
+// prefers reports whether the client would rather have the content coding enc
+// than the unencoded object: enc is acceptable, and the client did not give
+// the identity coding a higher quality, explicitly or by "*".
+func (a acceptEncoding) prefers(enc string) bool {
+	q := a.quality(enc)
+	if !a.sent || q <= 0 {
+		return false
+	}
+	if _, ok := a.q["identity"]; ok || a.q["*"] > 0 {
+		return q >= a.quality("identity")
+	}
+	return true
+}
+
+// variantEncoding returns the first of the PrecomputeVariants that the client
+// for r prefers to the unencoded object, with the highest quality value, or
+// "" if there is none.
+func (s *Server) variantEncoding(r *http.Request) string {
+	ae := parseAcceptEncoding(r.Header)
+	var best string
+	var bestQ float64
+	for _, enc := range s.PrecomputeVariants {
+		if _, ok := variantEncoders[enc]; !ok || !ae.prefers(enc) {
+			continue
+		}
+		if q := ae.quality(enc); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// serveVariant attempts to serve r from a stored variant of the object for
+// hash, in the encoding chosen by variantEncoding. It reports whether it did.
+func (s *Server) serveVariant(w http.ResponseWriter, r *http.Request, hash string, start time.Time) bool {
+	enc := s.variantEncoding(r)
+	if enc == "" {
+		return false
+	}
+	vhash := variantHash(hash, enc)
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+
+	// Only look for the variant in S3 if we would have to look there for the
+	// object anyway.
+	tiers := s.maxTiers(r)
+	if tiers < tierLocal {
+		return false
+	}
+	tier := "local"
+	data, hdr, err := s.cacheLoadLocal(vhash)
+	if err != nil {
+		if tiers < tierS3 || s.memHas(hash) || fileExists(s.makePath(hash)) {
+			return false
+		}
+		tier = "remote"
+		if data, hdr, err = s.cacheLoadS3(r.Context(), vhash); err != nil {
+			return false
+		}
+	}
+	if serve, _ := s.checkFreshness(r, reqCC, hdr, start); !serve {
+		return false
+	}
+	if tier == "remote" {
+		if err := s.cacheStoreLocal(vhash, hdr, data); err != nil {
+			s.logf("update %q local: %v", vhash, err)
+		}
+	}
+	traceOf(r).addf("variant", time.Time{}, "hit, %s %s", tier, enc)
+	s.reqVariantHit.Add(1)
+	setXCacheInfo(hdr, "hit, "+tier, vhash)
+	addVary(hdr, "Accept-Encoding")
+	s.writeCachedResponse(w, r, hdr, data)
+	s.vlogf("rp E H:%s hit variant %s B:%d (%v elapsed)", hash, enc, len(data), time.Since(start))
+	return true
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// hasVariants reports whether PrecomputeVariants may be stored for an object
+// with header h, one without a content encoding or range.
+func (s *Server) hasVariants(h http.Header) bool {
+	return len(s.PrecomputeVariants) != 0 && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == ""
+}
+
+// variantETag returns the entity tag for the variant in encoding enc of an
+// object with the given ETag. The variant is a different representation, so
+// it cannot share a strong entity tag with the object (RFC 9110 Section
+// 8.8.3); instead the encoding is appended to the opaque tag, so that "abc"
+// becomes "abc-gzip". If etag is not a well-formed entity tag, the variant
+// gets none, and the result is "".
+func variantETag(etag, enc string) string {
+	tag, weak := strings.CutPrefix(etag, "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return ""
+	}
+	tag = tag[:len(tag)-1] + "-" + enc + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// storeVariants returns a task that generates and stores each of the
+// PrecomputeVariants for the object for hash, from the copy in the local
+// cache. Objects that already have a content encoding are skipped. A variant
+// stored for an earlier copy of the object is removed if the current copy
+// does not get one, so that it is not served in place of the new content.
+func (s *Server) storeVariants(hash string) func() error {
+	return func() error {
+		body, hdr, err := s.cacheLoadLocal(hash)
+		if err != nil {
+			return nil
+		}
+		skip := !s.hasVariants(hdr)
+		if !skip && !s.looksCompressible(body) {
+			s.rspIncompressible.Add(1)
+			s.vlogf("skip variants %q: body is incompressible", hash)
+			skip = true
+		}
+		// The checksum of the object does not describe its variants.
+		hdr.Del(bodyChecksumHeader)
+		hdr.Del(checksumAlgoHeader)
+		hdr.Del(checksumHeader)
+		for _, enc := range s.PrecomputeVariants {
+			encode, ok := variantEncoders[enc]
+			if !ok {
+				continue // reported by checkVariants
+			}
+			vhash := variantHash(hash, enc)
+			var data []byte
+			if !skip {
+				if data, err = encode(body); err != nil {
+					s.logf("encode %q as %s: %v", hash, enc, err)
+					data = nil
+				} else if len(data) >= len(body) {
+					data = nil // not worthwhile
+				}
+			}
+			if data == nil {
+				s.removeVariant(hash, enc)
+				continue
+			}
+			vhdr := hdr.Clone()
+			vhdr.Set("Content-Encoding", enc)
+			if etag := variantETag(hdr.Get("Etag"), enc); etag != "" {
+				vhdr.Set("Etag", etag)
+			} else {
+				vhdr.Del("Etag")
+			}
+			if err := s.cacheStoreLocal(vhash, vhdr, data); err != nil {
+				s.logf("save %q variant %s: %v", hash, enc, err)
+				continue
+			}
+			s.rspSaveVariant.Add(1)
+			if err := s.cacheStoreS3(vhash, vhdr, data)(); err != nil {
+				continue // already logged
+			}
+		}
+		return nil
+	}
+}
+
+// removeVariant removes the stored variant in encoding enc of the object for
+// hash, if there is one, from the local cache and S3.
+func (s *Server) removeVariant(hash, enc string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	if err := s.removeObject(ctx, variantHash(hash, enc)); err != nil {
+		s.logf("remove %q variant %s: %v", hash, enc, err)
+	}
+}
+
+// incompressibleRatio is the compressed size of a sample, relative to its
+// original size, above which a body is considered not worth compressing.
+const incompressibleRatio = 0.9
+
+// looksCompressible reports whether body is likely to be worth compressing,
+// by compressing a sample of CompressibilitySampleBytes from its start. If
+// sampling is disabled, or the body is no longer than the sample, it reports
+// true, and the caller should find out by encoding the whole body.
+func (s *Server) looksCompressible(body []byte) bool {
+	n := s.CompressibilitySampleBytes
+	if n <= 0 || len(body) <= n {
+		return true
+	}
+	cw := &countWriter{w: io.Discard}
+	zw, _ := flate.NewWriter(cw, flate.BestSpeed)
+	zw.Write(body[:n])
+	if err := zw.Close(); err != nil {
+		return true
+	}
+	return float64(cw.n) <= incompressibleRatio*float64(n)
+}
+
+// checkVariants reports an error for each of the PrecomputeVariants that is
+// not supported. Brotli ("br") is reported separately, since it is a likely
+// choice that has no encoder here yet.
+func (s *Server) checkVariants() error {
+	var errs []error
+	for _, enc := range s.PrecomputeVariants {
+		if _, ok := variantEncoders[enc]; ok {
+			continue
+		} else if enc == "br" {
+			errs = append(errs, errors.New(`precomputed variant encoding "br" is not implemented`))
+		} else {
+			errs = append(errs, fmt.Errorf("unsupported precomputed variant encoding %q", enc))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// varyNames returns the canonical header names listed in the Vary headers of
+// h, in order and without duplicates. If any of them is "*", the result is
+// just "*", since the response varies on things other than the request
+// headers.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return []string{"*"}
+			} else if name != "" && !slices.Contains(names, http.CanonicalHeaderKey(name)) {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// normalizeVary replaces the Vary headers of h, if any, with a single header
+// listing the same names in canonical form, so that downstream caches see the
+// same Vary for a cached object however the origin spelled it.
+func normalizeVary(h http.Header) {
+	if names := varyNames(h); len(names) != 0 {
+		h.Set("Vary", strings.Join(names, ", "))
+	} else {
+		h.Del("Vary")
+	}
+}
+
+// addVary adds name to the Vary header of h, if it is not already listed.
+func addVary(h http.Header, name string) {
+	names := varyNames(h)
+	if slices.Contains(names, "*") || slices.Contains(names, http.CanonicalHeaderKey(name)) {
+		return
+	}
+	h.Set("Vary", strings.Join(append(names, http.CanonicalHeaderKey(name)), ", "))
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultWarmRate is the default rate limit for warming requests, in
+// requests per second.
+const defaultWarmRate = 10
+
+// Warm requests each of the specified URLs through the cache, so that later
+// requests for them can be served without contacting the origin. URLs whose
+// host is not one of the configured targets, or that cannot be parsed, are
+// logged and skipped. Requests are rate-limited by WarmRate.
+//
+// Warm returns early if ctx ends, reporting the error from ctx.
+func (s *Server) Warm(ctx context.Context, urls []string) error {
+	lim := s.newWarmLimiter()
+	for _, u := range urls {
+		if err := s.warmOne(ctx, lim, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarmFromReader reads lines from r, and for each line for which parse
+// reports true, warms the cache for the URL it returns as [Server.Warm] does.
+// Lines that parse rejects are silently skipped, which makes it possible to
+// prime the cache from an access log in any format.
+//
+// WarmFromReader returns early if ctx ends, reporting the error from ctx. It
+// also reports any error from reading r.
+func (s *Server) WarmFromReader(ctx context.Context, r io.Reader, parse func(line string) (url string, ok bool)) error {
+	lim := s.newWarmLimiter()
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		u, ok := parse(sc.Text())
+		if !ok {
+			continue
+		}
+		if err := s.warmOne(ctx, lim, u); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (s *Server) newWarmLimiter() *rate.Limiter {
+	r := s.WarmRate
+	if r <= 0 {
+		r = defaultWarmRate
+	}
+	return rate.NewLimiter(rate.Limit(r), 1)
+}
+
+// warmOne issues a request for rawURL through s, after waiting for lim.  It
+// reports an error only if ctx ends; other failures are logged.
+func (s *Server) warmOne(ctx context.Context, lim *rate.Limiter, rawURL string) error {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		s.logf("warm: skipping invalid URL %q", rawURL)
+		return nil
+	} else if !hostMatchesTarget(u.Host, s.Targets) {
+		s.logf("warm: skipping non-target URL %q", rawURL)
+		return nil
+	}
+	if err := lim.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		s.logf("warm: skipping %q: %v", rawURL, err)
+		return nil
+	}
+	req.RequestURI = u.String()
+
+	w := &warmResponse{header: make(http.Header)}
+	s.ServeHTTP(w, req)
+	s.vlogf("warm %q: status %d, %s", u, w.code, w.header.Get("X-Cache"))
+	return ctx.Err()
+}
+
+// warmResponse is a [http.ResponseWriter] that discards the response body,
+// used for warming requests.
+type warmResponse struct {
+	header http.Header
+	code   int
+}
+
+func (w *warmResponse) Header() http.Header { return w.header }
+
+func (w *warmResponse) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(data), nil
+}
+
+func (w *warmResponse) WriteHeader(code int) {
+	if w.code == 0 && code >= http.StatusOK {
+		w.code = code
+	}
+}